@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"slices"
+	"strings"
+
+	mqtts "github.com/mochi-mqtt/server/v2"
+)
+
+const (
+	MQTT_SCOPE_READ      = "read"
+	MQTT_SCOPE_READWRITE = "readwrite"
+)
+
+// MqttUser is an account of an integration (e.g. Home Assistant, Node-RED) on the local broker.
+type MqttUser struct {
+	Username string
+	Password string
+	Scope    string   // read (subscribe only) or readwrite
+	Gateways []string // the gateways the user may access, empty means all
+}
+
+func findMqttUser(username string) *MqttUser {
+	for i := range Config.Mqtt_users {
+		if Config.Mqtt_users[i].Username == username {
+			return &Config.Mqtt_users[i]
+		}
+	}
+	return nil
+}
+
+// authenticateMqttUser checks the credentials of an integration; ok is false if the username is not an account.
+func authenticateMqttUser(username, password []byte) (valid bool, ok bool) {
+	u := findMqttUser(string(username))
+	if u == nil {
+		return false, false
+	}
+	return subtle.ConstantTimeCompare([]byte(u.Password), password) == 1, true
+}
+
+// authenticateDevice checks the credentials of a device against its entry in Devices. The devices without
+// credentials there are accepted with any, unless Mqtt_device_credentials is turned on.
+func authenticateDevice(clID string, username, password []byte) bool {
+	device, ok := findDevice(clID)
+	if !ok || (device.Username == "" && device.Password == "") {
+		return !Config.Mqtt_device_credentials
+	}
+	validUser := subtle.ConstantTimeCompare([]byte(device.Username), username) == 1
+	validPassword := subtle.ConstantTimeCompare([]byte(device.Password), password) == 1
+	return validUser && validPassword
+}
+
+// warnDeviceCredentials logs the devices that are accepted with any credentials.
+func warnDeviceCredentials() {
+	if Config.Mqtt_device_credentials {
+		return
+	}
+	for _, device := range Config.Devices {
+		if device.GwID != "" && device.Username == "" && device.Password == "" {
+			log.Printf("warning: %v has no Username/Password in Devices, it is accepted with any credentials", device.GwID)
+		}
+	}
+	log.Printf("warning: devices missing from Devices are accepted with any credentials, see Mqtt_device_credentials")
+}
+
+// topicGateway returns the gateway of the device trees: $EDC/ari/<gw>/..., ari/<gw>/... and broker-ari/<gw>/...
+func topicGateway(topic string) (string, bool) {
+	v := strings.Split(topic, "/")
+	switch {
+	case len(v) >= 3 && v[0] == "$EDC" && v[1] == "ari":
+		return v[2], true
+	case len(v) >= 2 && (v[0] == "ari" || v[0] == STATE_TOPIC_PREFIX):
+		return v[1], true
+	}
+	return "", false
+}
+
+// isReplyTopic tells if the topic is a reply of a device to a requester, e.g. $EDC/ari/<requester>/ar1/REPLY/params.
+func isReplyTopic(topic string) bool {
+	v := strings.Split(topic, "/")
+	return len(v) >= 5 && v[0] == "$EDC" && v[1] == "ari" && v[4] == "REPLY"
+}
+
+// deviceACL confines a device to its own trees; it may also reply to the requesters that are not devices (the
+// broker itself and the clients of the cloud). Subscription filters with a wildcard in place of the gateway are
+// accepted, as every delivered message is checked too.
+func deviceACL(clID, topic string, write bool) bool {
+	gw, ok := topicGateway(topic)
+	if !ok || strings.HasPrefix(topic, STATE_TOPIC_PREFIX+"/") {
+		return false
+	}
+	if write {
+		return gw == clID || (isReplyTopic(topic) && !knownDevice(gw) && gw != "+" && gw != "#")
+	}
+	return gw == clID || gw == "+" || gw == "#"
+}
+
+// userACL applies the scope and the gateway restriction of an integration account.
+func userACL(u *MqttUser, topic string, write bool) bool {
+	if write && u.Scope != MQTT_SCOPE_READWRITE {
+		return false
+	}
+	if len(u.Gateways) == 0 {
+		return true
+	}
+	gw, ok := topicGateway(topic)
+	if !ok {
+		// topics not bound to a gateway, e.g. the Home Assistant discovery
+		return !strings.HasPrefix(topic, "#")
+	}
+	if gw == "+" || gw == "#" {
+		return !write
+	}
+	return slices.Contains(u.Gateways, gw)
+}
+
+// checkACL decides if the client may publish (write) or subscribe to the topic.
+func checkACL(cl *mqtts.Client, topic string, write bool) bool {
+	if cl.Net.Inline {
+		return true
+	}
+	if u := findMqttUser(string(cl.Properties.Username)); u != nil {
+		return userACL(u, topic, write)
+	}
+	if cl.Net.Listener == "tcp" && Config.Mqtt_clear_integrations {
+		// anonymous integrations are only accepted if there are no accounts
+		return len(Config.Mqtt_users) == 0
+	}
+	return deviceACL(cl.ID, topic, write)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"testing"
+
+	mqtts "github.com/mochi-mqtt/server/v2"
+)
+
+// withConfig runs the test with a copy of the config changed by set, and a registry knowing the gateways.
+func withConfig(t *testing.T, set func(c *config), gateways ...string) {
+	t.Helper()
+	oldConfig, oldRegistry := Config, registry
+	t.Cleanup(func() { Config, registry = oldConfig, oldRegistry })
+	set(&Config)
+	registry = newDeviceRegistry()
+	for _, gw := range gateways {
+		registry.Connect(gw, nil)
+	}
+}
+
+func TestDeviceACL(t *testing.T) {
+	withConfig(t, func(c *config) {
+		c.Devices = []Devices{{GwID: "GW3"}}
+	}, "GW1", "GW2")
+
+	for _, tc := range []struct {
+		topic string
+		write bool
+		want  bool
+	}{
+		{"$EDC/ari/GW1/MQTT/BIRTH", true, true},
+		{"$EDC/ari/GW1/ar1/GET/Menu/Par", false, true},
+		{"ari/GW1/something", true, true},
+		{"$EDC/ari/GW2/MQTT/BIRTH", true, false},
+		{"$EDC/ari/GW2/ar1/GET/Menu/Par", false, false},
+		// replies to the broker and to the clients of the cloud
+		{"$EDC/ari/inline/ar1/REPLY/result", true, true},
+		{"$EDC/ari/inline/ar1/REPLY/read-1", true, true},
+		{"$EDC/ari/app-1234/ar1/REPLY/42", true, true},
+		// replies into the tree of other devices, connected or configured
+		{"$EDC/ari/GW2/ar1/REPLY/params", true, false},
+		{"$EDC/ari/GW3/ar1/REPLY/params", true, false},
+		{"$EDC/ari/+/ar1/REPLY/params", true, false},
+		// wildcard subscriptions are checked on delivery
+		{"$EDC/ari/+/ar1/#", false, true},
+		{"$EDC/ari/#", false, true},
+		{"$EDC/ari/+/ar1/#", true, false},
+		// the plain topics of broker-ari and anything else
+		{"broker-ari/GW1/state", false, false},
+		{"broker-ari/GW1/set/reqTemp", true, false},
+		{"homeassistant/water_heater/GW1/config", true, false},
+		{"#", false, false},
+	} {
+		if got := deviceACL("GW1", tc.topic, tc.write); got != tc.want {
+			t.Errorf("deviceACL(GW1, %v, write=%v) = %v, want %v", tc.topic, tc.write, got, tc.want)
+		}
+	}
+}
+
+func TestCheckACL(t *testing.T) {
+	users := []MqttUser{
+		{Username: "ha", Password: "secret", Scope: MQTT_SCOPE_READWRITE},
+		{Username: "grafana", Password: "secret", Scope: MQTT_SCOPE_READ, Gateways: []string{"GW1"}},
+	}
+	client := func(listener, username string) *mqtts.Client {
+		return &mqtts.Client{
+			ID:         "GW1",
+			Net:        mqtts.ClientConnection{Listener: listener},
+			Properties: mqtts.ClientProperties{Username: []byte(username)},
+		}
+	}
+
+	for _, tc := range []struct {
+		name         string
+		users        []MqttUser
+		integrations bool
+		cl           *mqtts.Client
+		topic        string
+		write        bool
+		want         bool
+	}{
+		{"inline", users, false, &mqtts.Client{ID: "inline", Net: mqtts.ClientConnection{Inline: true}}, "$EDC/ari/GW2/ar1/GET/Menu/Par", true, true},
+		{"readwrite account", users, false, client("tcp", "ha"), "broker-ari/GW2/set/reqTemp", true, true},
+		{"read account publishing", users, false, client("tcp", "grafana"), "broker-ari/GW1/set/reqTemp", true, false},
+		{"read account, own gateway", users, false, client("tcp", "grafana"), "broker-ari/GW1/state", false, true},
+		{"read account, other gateway", users, false, client("tcp", "grafana"), "broker-ari/GW2/state", false, false},
+		{"read account, wildcard", users, false, client("tcp", "grafana"), "broker-ari/+/state", false, true},
+		{"device on TLS", users, false, client("t1s", ""), "$EDC/ari/GW2/MQTT/BIRTH", true, false},
+		{"device on TLS, own tree", users, false, client("t1s", ""), "$EDC/ari/GW1/MQTT/BIRTH", true, true},
+		// the clients of the clear text listener are devices unless Mqtt_clear_integrations is turned on
+		{"anonymous clear text", nil, false, client("tcp", ""), "broker-ari/GW2/state", false, false},
+		{"anonymous integration", nil, true, client("tcp", ""), "broker-ari/GW2/state", false, true},
+		{"anonymous integration with accounts", users, true, client("tcp", ""), "broker-ari/GW2/state", false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			withConfig(t, func(c *config) {
+				c.Mqtt_users = tc.users
+				c.Mqtt_clear_integrations = tc.integrations
+			}, "GW1", "GW2")
+			if got := checkACL(tc.cl, tc.topic, tc.write); got != tc.want {
+				t.Errorf("checkACL(%v, write=%v) = %v, want %v", tc.topic, tc.write, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAuthenticateDevice(t *testing.T) {
+	devices := []Devices{
+		{GwID: "GW1", Username: "user1", Password: "pass1"},
+		{GwID: "GW2"},
+		{GwID: "", Username: "template", Password: "template"},
+	}
+	for _, tc := range []struct {
+		name               string
+		required           bool
+		clID, user, passwd string
+		want               bool
+	}{
+		{"valid credentials", false, "GW1", "user1", "pass1", true},
+		{"wrong password", false, "GW1", "user1", "wrong", false},
+		{"wrong username", false, "GW1", "other", "pass1", false},
+		{"no credentials sent", false, "GW1", "", "", false},
+		{"device without credentials", false, "GW2", "any", "any", true},
+		{"unknown device", false, "GW9", "any", "any", true},
+		{"empty client ID does not match the templates", false, "", "any", "any", true},
+		{"required, valid credentials", true, "GW1", "user1", "pass1", true},
+		{"required, device without credentials", true, "GW2", "any", "any", false},
+		{"required, unknown device", true, "GW9", "any", "any", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			withConfig(t, func(c *config) {
+				c.Devices = devices
+				c.Mqtt_device_credentials = tc.required
+			})
+			if got := authenticateDevice(tc.clID, []byte(tc.user), []byte(tc.passwd)); got != tc.want {
+				t.Errorf("authenticateDevice(%v, %v, %v) = %v, want %v", tc.clID, tc.user, tc.passwd, got, tc.want)
+			}
+		})
+	}
+}
@@ -1,20 +1,42 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"net/http/httputil"
 	URL "net/url"
+	"os"
 	"strings"
-)
+	"time"
 
-var (
-	apiToken string
+	"github.com/irsl/broker-ari/arimsgs"
 )
 
+// apiError is returned by the handlers to respond with an error status. It is encoded like the
+// errors of the official API: {"Message": "..."}.
+type apiError struct {
+	status  int
+	Message string
+}
+
+func newAPIError(status int, format string, params ...any) *apiError {
+	return &apiError{status: status, Message: fmt.Sprintf(format, params...)}
+}
+
 func commonHandler(handler func(path string, body any, params URL.Values, method string) any) func(w http.ResponseWriter, req *http.Request) {
+	return sessionHandler("", func(req *http.Request, s apiSession, body any) any {
+		return handler(req.URL.Path, body, req.URL.Query(), req.Method)
+	})
+}
+
+// sessionHandler authorizes the request for the scope (by default derived from the method) and passes the
+// session to the handler.
+func sessionHandler(scope string, handler func(req *http.Request, s apiSession, body any) any) func(w http.ResponseWriter, req *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
 		if Config.Api_debug {
 			req.URL.Scheme = "http"
@@ -22,9 +44,14 @@ func commonHandler(handler func(path string, body any, params URL.Values, method
 			bytes, _ := httputil.DumpRequestOut(req, true)
 			log.Printf("API request:\n%s", bytes)
 		}
-		if req.URL.Path != "/accounts/login" && req.Header.Get("Ar.authtoken") != apiToken {
-			http.Error(w, "Invalid token", http.StatusBadRequest)
-			return
+		var s apiSession
+		if req.URL.Path != "/accounts/login" {
+			var e *apiError
+			s, e = authorize(req, scope)
+			if e != nil {
+				http.Error(w, e.Message, e.status)
+				return
+			}
 		}
 		var p any
 		if req.Method != "GET" {
@@ -34,7 +61,10 @@ func commonHandler(handler func(path string, body any, params URL.Values, method
 			}
 		}
 		w.Header().Set("Content-Type", "application/json")
-		result := handler(req.URL.Path, p, req.URL.Query(), req.Method)
+		result := filterGateways(s, handler(req, s, p))
+		if e, ok := result.(*apiError); ok {
+			w.WriteHeader(e.status)
+		}
 		json.NewEncoder(w).Encode(result)
 		if Config.Api_debug {
 			log.Printf("API result: %+v", result)
@@ -44,19 +74,18 @@ func commonHandler(handler func(path string, body any, params URL.Values, method
 
 func velisPlants(path string, body any, params URL.Values, method string) any {
 	re := []any{}
-	for clId, c := range clientMap {
+	for _, clId := range registry.IDs() {
+		c, _ := registry.Get(clId)
 		a := map[string]any{}
 		a["gw"] = clId
 		a["sn"] = c.birth["serial_number"]
 		a["fwVer"] = c.birth["firmware_version"]
 
-		for _, device := range Config.Devices {
-			if device.GwID == clId {
-				a["sys"] = device.Sys
-				a["wheType"] = device.WheType
-				a["wheModelType"] = device.WheModelType
-				a["name"] = device.Name
-			}
+		if device, ok := findDevice(clId); ok {
+			a["sys"] = device.Sys
+			a["wheType"] = device.WheType
+			a["wheModelType"] = device.WheModelType
+			a["name"] = device.Name
 		}
 
 		re = append(re, a)
@@ -73,286 +102,262 @@ func defaultHandler(path string, body any, params URL.Values, method string) any
 	return map[string]any{}
 }
 
-func login(path string, body any, params URL.Values, method string) any {
-	bmap, ok := body.(map[string]any)
-	if !ok {
-		return nil
-	}
-	if Config.Api_username != "" {
-		err := map[string]string{"error": "invalid username/password"}
-		usr := bmap["usr"].(string)
-		if usr != Config.Api_username {
-			return err
-		}
-		pwd := bmap["pwd"].(string)
-		if pwd != Config.Api_password {
-			return err
-		}
-	}
-
-	return map[string]any{"token": apiToken}
-}
-
+// velisPlantDataSet writes the parameter and waits for the device to confirm it.
 func velisPlantDataSet(clID, cat string, value int32) any {
-	b, err := putParams(cat, value)
-	if err == nil {
-		err = server.Publish("$EDC/ari/"+clID+"/ar1/PUT/Menu/Par", b, false, 0)
+	if err := checkRange(clID, cat, value); err != nil {
+		log.Printf("rejected write for %v %v %v: %v", clID, cat, value, err)
+		return newAPIError(http.StatusBadRequest, "%v", err)
 	}
-	if err != nil {
+	if err := writeParam(clID, cat, value); err != nil {
 		log.Printf("error for %v %v %v: %v", clID, cat, value, err)
-		return nil
-	}
-	// remembering the new setting so it is returned correctly even if the API is called before the next polling happens
-	if c, ok := clientMap[clID]; ok && c.params != nil {
-			c.params[cat] = value
+		return newAPIError(http.StatusBadGateway, "unable to set %v: %v", cat, err)
 	}
 	return map[string]bool{"success": true}
-
 }
 
+// busErrors serves the active faults; empty unless Error_list_decoding is turned on, see parseErrorList.
 func busErrors(path string, body any, params URL.Values, method string) any {
-	if c, ok := clientMap[params.Get("gatewayId")]; ok && c.errors != nil {
-		return map[string]any{} // TODO: return errors
+	clID := params.Get("gatewayId")
+	re := []any{}
+	if !Config.Error_list_decoding {
+		return re
 	}
-	return map[string]any{}
+	for _, f := range parseErrorList(clID, registry.Errors(clID)) {
+		re = append(re, busErrorEntry(clID, f))
+	}
+	return re
+}
+
+func busErrorsHistory(path string, body any, params URL.Values, method string) any {
+	if !Config.Error_list_decoding {
+		return []faultEvent{}
+	}
+	return faults.Get(params.Get("gatewayId"))
 }
 
 func features(path string, body any, params URL.Values, method string) any {
 	v := strings.Split(path, "/")
 	clID := v[3]
-	if c, ok := clientMap[clID]; ok && c.errors != nil {
+	if c, ok := registry.Get(clID); ok && c.errors != nil {
 		return map[string]any{"hasMetering": true}
 	}
 	return map[string]any{}
 }
 
-func consumption(path string, body any, params URL.Values, method string) any {
-	v := strings.Split(path, "/")
-	clID := v[3]
-
+// consumptionEntries converts the consumption report to the format of the official API.
+func consumptionEntries(clID string, cWh *arimsgs.ConsumptionMsg) []map[string]any {
 	offset := 0
-	for _, device := range Config.Devices {
-		if device.GwID == clID {
-			offset = device.ConsumptionOffset
-		}
+	if device, ok := findDevice(clID); ok {
+		offset = device.ConsumptionOffset
 	}
 
-	if c, ok := clientMap[clID]; ok && c.cWh != nil {
-		ret := []map[string]any{}
-		for _, consumptions := range c.cWh.Consumptions.Consumptions {
-			kwhs := make([]float32, len(consumptions.Wh))
-			for i, wh := range consumptions.Wh {
-				kwhs[i] = float32(wh) / 1000
-			}
+	ret := []map[string]any{}
+	for _, consumptions := range cWh.GetConsumptions().GetConsumptions() {
+		kwhs := make([]float32, len(consumptions.Wh))
+		for i, wh := range consumptions.Wh {
+			kwhs[i] = float32(wh) / 1000
+		}
 
-			re := map[string]any{}
-			re["k"] = consumptions.ConsumptionType + int32(offset)
-			re["p"] = consumptions.ConsumptionTimeInterval
-			re["v"] = kwhs
+		re := map[string]any{}
+		re["k"] = consumptions.ConsumptionType + int32(offset)
+		re["p"] = consumptions.ConsumptionTimeInterval
+		re["v"] = kwhs
 
-			ret = append(ret, re)
-		}
-		return ret
+		ret = append(ret, re)
 	}
-	return map[string]any{}
+	return ret
 }
 
-func medPlantData(path string, body any, params URL.Values, method string) any {
+func consumption(path string, body any, params URL.Values, method string) any {
 	v := strings.Split(path, "/")
 	clID := v[3]
-	switch {
-	case len(v) == 4:
-		re := map[string]any{}
-		if c, ok := clientMap[clID]; ok && c.params != nil {
-			re["on"] = c.params["T_18.0.0"]
-			re["mode"] = c.params["T_18.0.1"]
-			re["eco"] = c.params["T_18.0.2"]
-			re["pwrOpt"] = c.params["T_18.0.3"]
-
-			re["reqTemp"] = c.params["T_18.1.0"] / 10
 
-			re["antiLeg"] = c.params["T_18.3.0"]
-			re["avShw"] = c.params["T_18.3.1"]
-			var hours int32 = 0
-			var minutes int32 = c.params["T_18.3.2"]
-			if minutes > 60 {
-				hours = minutes / 60
-				minutes -= hours * 60
-			}
-			re["rmTm"] = fmt.Sprintf("%d:%d:0", hours, minutes)
-			re["temp"] = float32(c.params["T_18.3.3"]) / 10
-			re["heatReq"] = c.params["T_18.3.5"]
-			re["procReqTemp"] = c.params["T_18.3.6"] / 10
-
-			re["gw"] = clID
-		}
-		return re
-	case len(v) == 5 && v[4] == "temperature":
-		bodyMap := body.(map[string]any)
-		newTemp := int32(bodyMap["new"].(float64)) * 10
-		return velisPlantDataSet(clID, "T_18.1.0", newTemp)
-	case len(v) == 5 && v[4] == "mode":
-		bodyMap := body.(map[string]any)
-		newMode := int32(bodyMap["new"].(float64))
-		return velisPlantDataSet(clID, "T_18.0.1", newMode)
-	case len(v) == 5 && v[4] == "switch":
-		newMode := 0
-		if body.(bool) {
-			newMode = 1
-		}
-		return velisPlantDataSet(clID, "T_18.0.0", int32(newMode))
-	case len(v) == 5 && v[4] == "switchEco":
-		newMode := 0
-		if body.(bool) {
-			newMode = 1
-		}
-		return velisPlantDataSet(clID, "T_18.0.2", int32(newMode))
-	case len(v) == 5 && v[4] == "plantSettings":
-		if method == "POST" {
-			return postMedPlantSettings(body, clID)
-		}
-		re := map[string]any{}
-		if c, ok := clientMap[clID]; ok && c.params != nil {
-			re["MedAntilegionellaOnOff"] = c.params["T_18.0.5"]
-			re["MedMaxSetpointTemperature"] = c.params["T_18.1.3"] / 10
-			re["MedMaxSetpointTemperatureMin"] = c.paramsLimits["T_18.1.3"].Min / 10
-			re["MedMaxSetpointTemperatureMax"] = c.paramsLimits["T_18.1.3"].Max / 10
-		}
-		return re
-	default:
-		log.Printf("no route for path %s", path)
-		return nil
+	if c, ok := registry.Get(clID); ok && c.cWh != nil {
+		return consumptionEntries(clID, c.cWh)
 	}
+	return map[string]any{}
 }
 
-func postMedPlantSettings(body any, clID string) any {
-	bodyMap := body.(map[string]any)
-	for key, value := range bodyMap {
-		if key == "MedMaxSetpointTemperature" {
-			valueMap := value.(map[string]any)
-			newTemp := valueMap["new"].(int) * 10
-			return velisPlantDataSet(clID, "T_18.1.3", int32(newTemp))
-		}
-		if key == "MedAntilegionellaOnOff" {
-			valueMap := value.(map[string]any)
-			newMode := int(valueMap["new"].(float64))
-			return velisPlantDataSet(clID, "T_18.0.5", int32(newMode))
+// apiValue converts the raw value of the parameter the way the official API returns it.
+func apiValue(p catalogParam, value int32) any {
+	switch p.Api_format {
+	case "float":
+		return float32(value) / float32(p.Scale)
+	case "duration":
+		var hours int32 = 0
+		var minutes int32 = value
+		if minutes > 60 {
+			hours = minutes / 60
+			minutes -= hours * 60
 		}
+		return fmt.Sprintf("%d:%d:0", hours, minutes)
 	}
-	return nil
+	return value / p.Scale
 }
 
-func postSePlantSettings(body any, clID string) any {
-	bodyMap := body.(map[string]any)
-	for key, value := range bodyMap {
-		if key == "SeMaxSetpointTemperature" {
-			valueMap := value.(map[string]any)
-			newTemp := valueMap["new"].(int) * 10
-			return velisPlantDataSet(clID, "T_22.1.2", int32(newTemp))
-		}
-		if key == "SeAntiCoolingTemperature" {
-			valueMap := value.(map[string]any)
-			newTemp := valueMap["new"].(int) * 10
-			return velisPlantDataSet(clID, "T_22.1.4", int32(newTemp))
-		}
-		if key == "SeAntilegionellaOnOff" {
-			valueMap := value.(map[string]any)
-			newMode := int32(valueMap["new"].(float64))
-			return velisPlantDataSet(clID, "T_22.0.1", newMode)
-		}
-		if key == "SePermanentBoostOnOff" {
-			valueMap := value.(map[string]any)
-			newMode := int32(valueMap["new"].(float64))
-			return velisPlantDataSet(clID, "T_22.0.2", newMode)
-		}
-		if key == "SeNightModeOnOff" {
-			valueMap := value.(map[string]any)
-			newMode := int32(valueMap["new"].(float64))
-			return velisPlantDataSet(clID, "T_22.0.4", newMode)
-		}
-		if key == "SeAntiCoolingOnOff" {
-			valueMap := value.(map[string]any)
-			newMode := int32(valueMap["new"].(float64))
-			return velisPlantDataSet(clID, "T_22.0.5", newMode)
+// apiSetValue converts the new value sent to the official API to the raw value of the parameter.
+// The official API sends either a bool (switches), a number or an object like {"new": 55, "old": 50}.
+func apiSetValue(p catalogParam, body any) (int32, bool) {
+	switch b := body.(type) {
+	case bool:
+		if b {
+			return 1, true
 		}
+		return 0, true
+	case float64:
+		return int32(math.Round(b * float64(p.Scale))), true
+	case map[string]any:
+		return apiSetValue(p, b["new"])
 	}
-	return nil
+	return 0, false
 }
 
-func sePlantData(path string, body any, params URL.Values, method string) any {
+func plantData(path string, body any, params URL.Values, method string) any {
 	v := strings.Split(path, "/")
 	clID := v[3]
+	m := modelByApi(clID, v[2])
+	if m == nil {
+		log.Printf("no catalog model for path %s", path)
+		return nil
+	}
 	switch {
 	case len(v) == 4:
 		re := map[string]any{}
-		if c, ok := clientMap[clID]; ok && c.params != nil {
-			re["on"] = c.params["T_22.0.0"]
-			re["mode"] = c.params["T_22.0.3"]
-			re["boostReqTemp"] = c.params["T_22.1.0"] / 10
-			re["reqTemp"] = c.params["T_22.1.3"] / 10
-			re["heatReq"] = c.params["T_22.3.0"]
-			re["procReqTemp"] = c.params["T_22.3.1"] / 10
-			re["antiLeg"] = c.params["T_22.3.4"]
-			re["temp"] = float32(c.params["T_22.3.6"]) / 10
-			re["avShw"] = c.params["T_22.3.9"]
-
+		if c, ok := registry.Get(clID); ok && c.params != nil {
+			for _, p := range m.Params {
+				if p.Api != "" {
+					re[p.Api] = apiValue(p, c.params[p.Key])
+				}
+			}
 			re["gw"] = clID
+			if c.stale {
+				// last known values, the device is not connected (yet)
+				re["stale"] = true
+				re["updated"] = c.updated.UTC().Format(time.RFC3339)
+			}
 		}
 		return re
-	case len(v) == 5 && v[4] == "temperature":
-		bodyMap := body.(map[string]any)
-		newTemp := int32(bodyMap["new"].(float64)) * 10
-		return velisPlantDataSet(clID, "T_22.1.3", newTemp)
-	case len(v) == 5 && v[4] == "mode":
-		bodyMap := body.(map[string]any)
-		newMode := int32(bodyMap["new"].(float64))
-		return velisPlantDataSet(clID, "T_22.0.3", newMode)
-	case len(v) == 5 && v[4] == "switch":
-		newMode := 0
-		if body.(bool) {
-			newMode = 1
-		}
-		return velisPlantDataSet(clID, "T_22.0.0", int32(newMode))
 	case len(v) == 5 && v[4] == "plantSettings":
 		if method == "POST" {
-			return postSePlantSettings(body, clID)
+			return postPlantSettings(m, body, clID)
 		}
 		re := map[string]any{}
-		if c, ok := clientMap[clID]; ok && c.params != nil {
-			re["SeAntilegionellaOnOff"] = c.params["T_22.0.1"]
-			re["SePermanentBoostOnOff"] = c.params["T_22.0.2"]
-			re["SeNightModeOnOff"] = c.params["T_22.0.4"]
-			re["SeAntiCoolingOnOff"] = c.params["T_22.0.5"]
-			re["SeMaxSetpointTemperature"] = c.params["T_22.1.2"] / 10
-			re["SeMaxSetpointTemperatureMin"] = c.paramsLimits["T_22.1.2"].Min / 10
-			re["SeMaxSetpointTemperatureMax"] = c.paramsLimits["T_22.1.2"].Max / 10
-			re["SeAntiCoolingTemperature"] = c.params["T_22.1.4"] / 10
-			re["SeAntiCoolingTemperatureMin"] = c.paramsLimits["T_22.1.4"].Min / 10
-			re["SeAntiCoolingTemperatureMax"] = c.paramsLimits["T_22.1.4"].Max / 10
+		if c, ok := registry.Get(clID); ok && c.params != nil {
+			for _, p := range m.Params {
+				if p.Setting == "" {
+					continue
+				}
+				re[p.Setting] = apiValue(p, c.params[p.Key])
+				if p.Setting_limits {
+					re[p.Setting+"Min"] = apiValue(p, c.paramsLimits[p.Key].Min)
+					re[p.Setting+"Max"] = apiValue(p, c.paramsLimits[p.Key].Max)
+				}
+			}
 		}
 		return re
+	case len(v) == 5:
+		for _, p := range m.Params {
+			if p.Api_set != v[4] {
+				continue
+			}
+			value, ok := apiSetValue(p, body)
+			if !ok {
+				log.Printf("invalid value for %s: %v", path, body)
+				return newAPIError(http.StatusBadRequest, "invalid value for %v", p.Api_set)
+			}
+			return velisPlantDataSet(clID, p.Key, value)
+		}
+		log.Printf("no route for path %s", path)
+		return nil
 	default:
 		log.Printf("no route for path %s", path)
 		return nil
 	}
 }
 
-func apiLogic() {
-	apiToken = fmt.Sprintf("%v:%v", Config.Api_username, Config.Api_password)
+func postPlantSettings(m *catalogModel, body any, clID string) any {
+	bodyMap, ok := body.(map[string]any)
+	if !ok {
+		return nil
+	}
+	for key, value := range bodyMap {
+		for _, p := range m.Params {
+			if p.Setting == "" || p.Setting != key {
+				continue
+			}
+			newValue, ok := apiSetValue(p, value)
+			if !ok {
+				log.Printf("invalid value for %s: %v", key, value)
+				return newAPIError(http.StatusBadRequest, "invalid value for %v", key)
+			}
+			return velisPlantDataSet(clID, p.Key, newValue)
+		}
+	}
+	return nil
+}
 
+func apiLogic() {
 	http.HandleFunc("/accounts/login", commonHandler(login))
+	http.HandleFunc("/accounts/logout", sessionHandler(API_SCOPE_READ, tokenHandler))
+	http.HandleFunc("/accounts/tokens", sessionHandler(API_SCOPE_ADMIN, tokenHandler))
 	http.HandleFunc("/remote/plants", commonHandler(remotePlants))
 	http.HandleFunc("/velis/plants", commonHandler(velisPlants))
-	http.HandleFunc("/velis/medPlantData/", commonHandler(medPlantData))
-	http.HandleFunc("/velis/sePlantData/", commonHandler(sePlantData))
+	for _, api := range catalogApis() {
+		http.HandleFunc("/velis/"+api+"/", commonHandler(plantData))
+	}
 	http.HandleFunc("/busErrors", commonHandler(busErrors))
+	http.HandleFunc("/busErrors/history", commonHandler(busErrorsHistory))
+	http.HandleFunc("/history/", commonHandler(history))
+	http.HandleFunc("/proxy", commonHandler(proxyStatus))
 	http.HandleFunc("/remote/plants/", commonHandler(features))
 	http.HandleFunc("/remote/reports/", commonHandler(consumption))
+	restApiLogic()
+	uiLogic()
 	http.HandleFunc("/", commonHandler(defaultHandler))
-	go func() {
-		log.Printf("API server listening on %v", Config.Api_listener)
-		if err := http.ListenAndServe(Config.Api_listener, nil); err != nil {
+	if Config.Api_listener != "" && Config.Api_tls_listener != "" && Config.Api_client_ca_path != "" {
+		// the plain listener would let the clients bypass the certificate check
+		log.Printf("Api_client_ca_path is set, not serving the API on %v without TLS", Config.Api_listener)
+	} else if Config.Api_listener != "" {
+		go func() {
+			log.Printf("API server listening on %v", Config.Api_listener)
+			if err := http.ListenAndServe(Config.Api_listener, nil); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+	if Config.Api_tls_listener != "" {
+		srv := &http.Server{Addr: Config.Api_tls_listener, TLSConfig: apiTLSConfig()}
+		go func() {
+			log.Printf("API server listening on %v (TLS)", Config.Api_tls_listener)
+			if err := srv.ListenAndServeTLS("", ""); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+}
+
+// apiTLSConfig serves the certificate of the broker, or Api_certificate_path if set. With Api_client_ca_path
+// only the clients with a certificate signed by that CA are accepted.
+func apiTLSConfig() *tls.Config {
+	certs := getBrokerCerts()
+	if Config.Api_certificate_path != "" {
+		m, err := newCertManager(Config.Api_certificate_path, Config.Api_private_key_path)
+		if err != nil {
 			log.Fatal(err)
 		}
-	}()
+		certs = m
+	}
+	cfg := &tls.Config{GetCertificate: certs.GetCertificate}
+	if Config.Api_client_ca_path != "" {
+		pem, err := os.ReadFile(Config.Api_client_ca_path)
+		if err != nil {
+			log.Fatalf("unable to read the API client CA: %v", err)
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			log.Fatalf("no certificates in the API client CA %v", Config.Api_client_ca_path)
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg
 }
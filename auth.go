@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	URL "net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	API_SCOPE_READ    = "read"    // GET requests
+	API_SCOPE_CONTROL = "control" // changing the settings of the devices
+	API_SCOPE_ADMIN   = "admin"   // managing broker-ari itself
+
+	DEFAULT_API_TOKEN_TTL = 7 * 24 * 3600
+)
+
+var apiScopeLevels = map[string]int{API_SCOPE_READ: 1, API_SCOPE_CONTROL: 2, API_SCOPE_ADMIN: 3}
+
+// ApiUser is an account of the API. The password is stored as a bcrypt hash, e.g. the output of
+// htpasswd -nbBC 10 "" <password> | cut -d: -f2
+type ApiUser struct {
+	Username      string
+	Password_hash string
+	Scope         string   // read, control or admin
+	Gateways      []string // the gateways the user may access, empty means all
+}
+
+// apiSession is a token handed out by login.
+type apiSession struct {
+	Username string    `json:"username"`
+	Scope    string    `json:"scope"`
+	Gateways []string  `json:"gateways,omitempty"`
+	Expires  time.Time `json:"expires"`
+}
+
+// can tells if the session has at least the given scope.
+func (s *apiSession) can(scope string) bool {
+	return apiScopeLevels[s.Scope] >= apiScopeLevels[scope]
+}
+
+// canAccess tells if the session may access the gateway.
+func (s *apiSession) canAccess(gw string) bool {
+	return len(s.Gateways) == 0 || slices.Contains(s.Gateways, gw)
+}
+
+// tokenStore keeps the sessions in memory; the tokens are random, so a restart logs everyone out. The expiry is
+// sliding: every request extends the lifetime of the token.
+type tokenStore struct {
+	mu       sync.Mutex
+	sessions map[string]*apiSession
+}
+
+var tokens = &tokenStore{sessions: map[string]*apiSession{}}
+
+func apiTokenTTL() time.Duration {
+	if Config.Api_token_ttl > 0 {
+		return time.Duration(Config.Api_token_ttl) * time.Second
+	}
+	return DEFAULT_API_TOKEN_TTL * time.Second
+}
+
+func (t *tokenStore) Issue(s apiSession) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	s.Expires = time.Now().Add(apiTokenTTL())
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sessions[token] = &s
+	return token, nil
+}
+
+// Lookup returns the session of a valid token and extends its lifetime.
+func (t *tokenStore) Lookup(token string) (apiSession, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.sessions[token]
+	if !ok {
+		return apiSession{}, false
+	}
+	now := time.Now()
+	if now.After(s.Expires) {
+		delete(t.sessions, token)
+		return apiSession{}, false
+	}
+	s.Expires = now.Add(apiTokenTTL())
+	return *s, true
+}
+
+func (t *tokenStore) Revoke(token string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.sessions, token)
+}
+
+// RevokeUser revokes every token of the user and returns how many there were.
+func (t *tokenStore) RevokeUser(username string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for token, s := range t.sessions {
+		if s.Username == username {
+			delete(t.sessions, token)
+			n++
+		}
+	}
+	return n
+}
+
+// List returns the live sessions.
+func (t *tokenStore) List() []apiSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	re := []apiSession{}
+	for token, s := range t.sessions {
+		if now.After(s.Expires) {
+			delete(t.sessions, token)
+			continue
+		}
+		re = append(re, *s)
+	}
+	slices.SortFunc(re, func(a, b apiSession) int { return strings.Compare(a.Username, b.Username) })
+	return re
+}
+
+// authenticate checks the credentials against Api_users and the legacy Api_username/Api_password, which is an
+// admin. Without any account the API is open, everyone logging in is an admin.
+func authenticate(username, password string) (apiSession, bool) {
+	for _, u := range Config.Api_users {
+		if u.Username != username {
+			continue
+		}
+		if bcrypt.CompareHashAndPassword([]byte(u.Password_hash), []byte(password)) != nil {
+			return apiSession{}, false
+		}
+		scope := u.Scope
+		if _, ok := apiScopeLevels[scope]; !ok {
+			scope = API_SCOPE_READ
+		}
+		return apiSession{Username: u.Username, Scope: scope, Gateways: u.Gateways}, true
+	}
+	if Config.Api_username != "" {
+		if subtle.ConstantTimeCompare([]byte(username), []byte(Config.Api_username)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(Config.Api_password)) == 1 {
+			return apiSession{Username: username, Scope: API_SCOPE_ADMIN}, true
+		}
+		return apiSession{}, false
+	}
+	if len(Config.Api_users) == 0 {
+		return apiSession{Username: username, Scope: API_SCOPE_ADMIN}, true
+	}
+	return apiSession{}, false
+}
+
+// hasAdminAccount tells if an admin is configured explicitly: Api_username or an admin in Api_users. Without
+// it everyone logging in is an admin, which is not enough for managing broker-ari itself.
+func hasAdminAccount() bool {
+	if Config.Api_username != "" {
+		return true
+	}
+	for _, u := range Config.Api_users {
+		if u.Scope == API_SCOPE_ADMIN {
+			return true
+		}
+	}
+	return false
+}
+
+// requestToken returns the token of the request: the ar.authtoken header of the official API or a bearer token.
+func requestToken(req *http.Request) string {
+	if token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	return req.Header.Get("Ar.authtoken")
+}
+
+// authorize finds the session of the request and checks its scope and gateway restriction. Requests
+// are read-only if they are GETs, the rest need the control scope unless the route requires more.
+func authorize(req *http.Request, scope string) (apiSession, *apiError) {
+	s, ok := tokens.Lookup(requestToken(req))
+	if !ok {
+		return apiSession{}, newAPIError(http.StatusBadRequest, "Invalid token")
+	}
+	if scope == "" {
+		scope = API_SCOPE_READ
+		if req.Method != http.MethodGet {
+			scope = API_SCOPE_CONTROL
+		}
+	}
+	if !s.can(scope) {
+		return s, newAPIError(http.StatusForbidden, "the %v scope is required", scope)
+	}
+	if len(s.Gateways) > 0 {
+		gws := append(strings.Split(req.URL.Path, "/"), req.URL.Query().Get("gatewayId"))
+		for _, gw := range gws {
+			if gw == "" || s.canAccess(gw) {
+				continue
+			}
+			if _, known := registry.Get(gw); known {
+				return s, newAPIError(http.StatusForbidden, "no access to %v", gw)
+			}
+			if _, known := findDevice(gw); known {
+				return s, newAPIError(http.StatusForbidden, "no access to %v", gw)
+			}
+		}
+	}
+	return s, nil
+}
+
+// filterGateways drops the entries of the lists (e.g. the plants) the session has no access to.
+func filterGateways(s apiSession, result any) any {
+	list, ok := result.([]any)
+	if !ok || len(s.Gateways) == 0 {
+		return result
+	}
+	re := []any{}
+	for _, e := range list {
+		if m, ok := e.(map[string]any); ok {
+			if gw, ok := m["gw"].(string); ok && !s.canAccess(gw) {
+				continue
+			}
+		}
+		re = append(re, e)
+	}
+	return re
+}
+
+func login(path string, body any, params URL.Values, method string) any {
+	bmap, ok := body.(map[string]any)
+	if !ok {
+		return nil
+	}
+	usr, _ := bmap["usr"].(string)
+	pwd, _ := bmap["pwd"].(string)
+	s, ok := authenticate(usr, pwd)
+	if !ok {
+		return map[string]string{"error": "invalid username/password"}
+	}
+	token, err := tokens.Issue(s)
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, "unable to issue a token: %v", err)
+	}
+	return map[string]any{"token": token}
+}
+
+// tokenHandler serves the token management: POST /accounts/logout revokes the token of the request,
+// GET /accounts/tokens lists the sessions and DELETE /accounts/tokens?username=x revokes the tokens of a user.
+func tokenHandler(req *http.Request, s apiSession, body any) any {
+	switch {
+	case req.URL.Path == "/accounts/logout":
+		tokens.Revoke(requestToken(req))
+		return map[string]bool{"success": true}
+	case req.Method == http.MethodGet:
+		return tokens.List()
+	case req.Method == http.MethodDelete:
+		return map[string]int{"revoked": tokens.RevokeUser(req.URL.Query().Get("username"))}
+	}
+	return newAPIError(http.StatusMethodNotAllowed, "unsupported method %v", req.Method)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/irsl/broker-ari/arimsgs"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	CAPTURE_IN  = "in"  // published by the client to the broker
+	CAPTURE_OUT = "out" // delivered by the broker to the client
+)
+
+// captureRecord is a line of the capture file (JSON Lines).
+type captureRecord struct {
+	Time      time.Time       `json:"time"`
+	Client    string          `json:"client"`
+	Direction string          `json:"direction"`
+	Topic     string          `json:"topic"`
+	Qos       byte            `json:"qos"`
+	Retain    bool            `json:"retain,omitempty"`
+	Payload   []byte          `json:"payload"`           // base64
+	Decoded   json.RawMessage `json:"decoded,omitempty"` // the protobuf message, if the payload could be decoded
+}
+
+// captureWriter records every message going through the local broker, see Mqtt_capture_path.
+type captureWriter struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+var capture *captureWriter
+
+func openCapture(path string) (*captureWriter, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &captureWriter{f: f}, nil
+}
+
+// decodePayload returns the protobuf message of the payload as JSON: the consumption reports are
+// ConsumptionMsg, everything else is ParametersMsg.
+func decodePayload(topic string, payload []byte) json.RawMessage {
+	if len(payload) == 0 {
+		return nil
+	}
+	var msg proto.Message = &arimsgs.ParametersMsg{}
+	if strings.HasSuffix(topic, "/REPLY/consumptions") {
+		msg = &arimsgs.ConsumptionMsg{}
+	}
+	if err := proto.Unmarshal(payload, msg); err != nil {
+		return nil
+	}
+	b, err := protojson.Marshal(msg)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// Record appends the message to the capture; it is a no-op if capturing is turned off.
+func (c *captureWriter) Record(clID, direction string, pk packets.Packet) {
+	if c == nil || pk.FixedHeader.Type != packets.Publish {
+		return
+	}
+	b, err := json.Marshal(captureRecord{
+		Time:      time.Now().UTC(),
+		Client:    clID,
+		Direction: direction,
+		Topic:     pk.TopicName,
+		Qos:       pk.FixedHeader.Qos,
+		Retain:    pk.FixedHeader.Retain,
+		Payload:   pk.Payload,
+		Decoded:   decodePayload(pk.TopicName, pk.Payload),
+	})
+	if err != nil {
+		log.Printf("unable to encode the capture record: %v", err)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.f.Write(append(b, '\n')); err != nil {
+		log.Printf("unable to write the capture: %v", err)
+	}
+}
+
+// readCapture reads the records of a capture file.
+func readCapture(path string) ([]captureRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	records := []captureRecord{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var r captureRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, scanner.Err()
+}
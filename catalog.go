@@ -0,0 +1,212 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	DEFAULT_CATALOG_PATH = "/config/catalog"
+)
+
+//go:embed catalog/*.json
+var embeddedCatalog embed.FS
+
+// catalogParam describes a parameter of a device model.
+type catalogParam struct {
+	Key             string // parameter key, e.g. T_18.1.0
+	Id              string // friendly name used in the MQTT topics, defaults to the key
+	Name            string // human readable name
+	Unit            string
+	Scale           int32 // the raw value is the real value multiplied by this
+	Writable        bool
+	Min             *float64 // limits of the writes (scaled) if the device does not report them
+	Max             *float64
+	Api             string // field name in the plant data of the official API
+	Api_format      string // "" (integer), "float" or "duration" (minutes returned as h:m:s)
+	Api_set         string // path of the official API setting this parameter, e.g. temperature
+	Setting         string // field name in the plantSettings of the official API
+	Setting_limits  bool   // if the plantSettings should also include the Min/Max of the parameter
+	Ha              string // Home Assistant component: water_heater, sensor, switch or number
+	Ha_device_class string
+}
+
+// catalogModel describes a device family: the parameters that are polled and how they are exposed.
+type catalogModel struct {
+	Name        string
+	Description string
+	Sys         int
+	WheType     int
+	Api         string // name of the plant data endpoint of the official API, e.g. medPlantData
+	Params      []catalogParam
+	Errors      map[string]catalogError // known fault codes
+
+	// the profile of the discovered devices
+	Birth_models      []string // model names in the birth certificate, e.g. model_name or display_name
+	WheModelType      int
+	ConsumptionTyp    string
+	ConsumptionOffset int
+}
+
+// catalogError describes a fault code reported in the error list.
+type catalogError struct {
+	Description string
+	Severity    int32
+}
+
+var (
+	catalog    = map[string]*catalogModel{}
+	catalogMux sync.RWMutex
+)
+
+func (m *catalogModel) normalize() {
+	for i := range m.Params {
+		p := &m.Params[i]
+		if p.Id == "" {
+			p.Id = p.Key
+		}
+		if p.Scale == 0 {
+			p.Scale = 1
+		}
+	}
+}
+
+// PollKeys returns the keys to be read out periodically.
+func (m *catalogModel) PollKeys() []string {
+	keys := make([]string, len(m.Params))
+	for i, p := range m.Params {
+		keys[i] = p.Key
+	}
+	return keys
+}
+
+// Param finds a parameter by its key or its friendly name.
+func (m *catalogModel) Param(name string) (catalogParam, bool) {
+	for _, p := range m.Params {
+		if p.Key == name || p.Id == name {
+			return p, true
+		}
+	}
+	return catalogParam{}, false
+}
+
+func parseCatalogModel(b []byte, name string) (*catalogModel, error) {
+	m := &catalogModel{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("unable to parse catalog file %v: %v", name, err)
+	}
+	if m.Name == "" {
+		return nil, fmt.Errorf("catalog file %v has no Name", name)
+	}
+	m.normalize()
+	return m, nil
+}
+
+// loadCatalog reads the built-in models and then the ones in the catalog directory, which override
+// the built-in ones with the same Name.
+func loadCatalog() {
+	models := map[string]*catalogModel{}
+
+	files, _ := fs.Glob(embeddedCatalog, "catalog/*.json")
+	for _, f := range files {
+		b, err := embeddedCatalog.ReadFile(f)
+		if err != nil {
+			log.Fatal(err)
+		}
+		m, err := parseCatalogModel(b, f)
+		if err != nil {
+			log.Fatal(err)
+		}
+		models[m.Name] = m
+	}
+
+	dir := Config.Catalog_path
+	if dir == "" {
+		dir = DEFAULT_CATALOG_PATH
+	}
+	files, _ = filepath.Glob(filepath.Join(dir, "*.json"))
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			log.Printf("unable to read catalog file: %v", err)
+			continue
+		}
+		m, err := parseCatalogModel(b, f)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		log.Printf("using catalog model %v from %v", m.Name, f)
+		models[m.Name] = m
+	}
+
+	catalogMux.Lock()
+	catalog = models
+	catalogMux.Unlock()
+}
+
+// catalogModels returns the models sorted by their name.
+func catalogModels() []*catalogModel {
+	catalogMux.RLock()
+	defer catalogMux.RUnlock()
+	models := make([]*catalogModel, 0, len(catalog))
+	for _, m := range catalog {
+		models = append(models, m)
+	}
+	sort.Slice(models, func(i, j int) bool { return models[i].Name < models[j].Name })
+	return models
+}
+
+// findModel returns the catalog model matching the configuration of the device.
+func findModel(device Devices) *catalogModel {
+	for _, m := range catalogModels() {
+		if m.Sys == device.Sys && m.WheType == device.WheType {
+			return m
+		}
+	}
+	return nil
+}
+
+// deviceModel returns the catalog model of the gateway, configured or discovered.
+func deviceModel(gwID string) *catalogModel {
+	device, ok := findDevice(gwID)
+	if !ok {
+		return nil
+	}
+	return findModel(device)
+}
+
+// catalogApis returns the names of the plant data endpoints the catalog provides.
+func catalogApis() []string {
+	apis := []string{}
+	seen := map[string]bool{}
+	for _, m := range catalogModels() {
+		if m.Api != "" && !seen[m.Api] {
+			seen[m.Api] = true
+			apis = append(apis, m.Api)
+		}
+	}
+	sort.Strings(apis)
+	return apis
+}
+
+// modelByApi returns the catalog model serving the gateway on the given plant data endpoint: the model of
+// the device if it matches, otherwise the first one providing the endpoint.
+func modelByApi(gwID, api string) *catalogModel {
+	if m := deviceModel(gwID); m != nil && m.Api == api {
+		return m
+	}
+	for _, m := range catalogModels() {
+		if m.Api == api {
+			return m
+		}
+	}
+	return nil
+}
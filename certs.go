@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	BROKER_HOSTNAME = "broker-ari.everyware-cloud.com"
+
+	DEFAULT_CERTIFICATE_PATH = "/config/" + BROKER_HOSTNAME + ".crt"
+	DEFAULT_PRIVATE_KEY_PATH = "/config/" + BROKER_HOSTNAME + ".key"
+
+	CERT_VALIDITY       = 365 * 24 * time.Hour
+	CERT_RENEW_BEFORE   = 30 * 24 * time.Hour
+	CERT_CHECK_INTERVAL = 24 * time.Hour
+
+	// certificates generated by broker-ari are tagged with this organization, only those are rotated
+	CERT_ORGANIZATION = "broker-ari"
+)
+
+// certManager serves the certificate of a TLS listener. The certificate is generated if the files do not
+// exist, rotated before it expires if it was generated by broker-ari, and reloaded whenever the files change.
+type certManager struct {
+	certPath string
+	keyPath  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+var (
+	brokerCerts    *certManager
+	brokerCertsMux sync.Mutex
+)
+
+// getBrokerCerts returns the manager of the certificate of broker-ari.everyware-cloud.com, starting it on the first call.
+func getBrokerCerts() *certManager {
+	brokerCertsMux.Lock()
+	defer brokerCertsMux.Unlock()
+	if brokerCerts == nil {
+		certPath, keyPath := Config.Mqtt_broker_certificate_path, Config.Mqtt_broker_private_key_path
+		if certPath == "" {
+			certPath = DEFAULT_CERTIFICATE_PATH
+		}
+		if keyPath == "" {
+			keyPath = DEFAULT_PRIVATE_KEY_PATH
+		}
+		m, err := newCertManager(certPath, keyPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		brokerCerts = m
+	}
+	return brokerCerts
+}
+
+func newCertManager(certPath, keyPath string) (*certManager, error) {
+	m := &certManager{certPath: certPath, keyPath: keyPath}
+	_, certErr := os.Stat(certPath)
+	_, keyErr := os.Stat(keyPath)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		if err := m.generate(); err != nil {
+			return nil, err
+		}
+	}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	m.rotateIfNeeded()
+	go m.watch()
+	go func() {
+		for {
+			time.Sleep(CERT_CHECK_INTERVAL)
+			m.rotateIfNeeded()
+		}
+	}()
+	return m, nil
+}
+
+// GetCertificate is used as tls.Config.GetCertificate, so the listeners pick up the new certificate right away.
+func (m *certManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.cert, nil
+}
+
+func (m *certManager) load() error {
+	cert, err := tls.LoadX509KeyPair(m.certPath, m.keyPath)
+	if err != nil {
+		return fmt.Errorf("unable to load the certificate %v: %v", m.certPath, err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("unable to parse the certificate %v: %v", m.certPath, err)
+		}
+	}
+	m.mu.Lock()
+	m.cert = &cert
+	m.mu.Unlock()
+	log.Printf("loaded the certificate %v, valid until %v", m.certPath, cert.Leaf.NotAfter)
+	return nil
+}
+
+// generate creates a new self-signed certificate for broker-ari.everyware-cloud.com.
+func (m *certManager) generate() error {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: BROKER_HOSTNAME, Organization: []string{CERT_ORGANIZATION}},
+		DNSNames:              []string{BROKER_HOSTNAME},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(CERT_VALIDITY),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("unable to create the certificate: %v", err)
+	}
+
+	// the key is written first, so the watcher does not load a new certificate with the old key
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := writeFileAtomic(m.keyPath, keyPem, 0600); err != nil {
+		return fmt.Errorf("unable to write the private key: %v", err)
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := writeFileAtomic(m.certPath, certPem, 0644); err != nil {
+		return fmt.Errorf("unable to write the certificate: %v", err)
+	}
+	log.Printf("generated a self-signed certificate for %v: %v", BROKER_HOSTNAME, m.certPath)
+	return nil
+}
+
+// rotateIfNeeded replaces the certificate generated by broker-ari if it expires soon. Certificates provided
+// by the user are never replaced, only warned about.
+func (m *certManager) rotateIfNeeded() {
+	m.mu.RLock()
+	leaf := m.cert.Leaf
+	m.mu.RUnlock()
+	if time.Until(leaf.NotAfter) > CERT_RENEW_BEFORE {
+		return
+	}
+	if len(leaf.Subject.Organization) != 1 || leaf.Subject.Organization[0] != CERT_ORGANIZATION {
+		log.Printf("WARNING: the certificate %v expires at %v", m.certPath, leaf.NotAfter)
+		return
+	}
+	if err := m.generate(); err != nil {
+		log.Printf("unable to rotate the certificate: %v", err)
+		return
+	}
+	if err := m.load(); err != nil {
+		log.Print(err)
+	}
+}
+
+// watch reloads the certificate when the files change. The directory is watched, so files replaced by a
+// rename (e.g. by an editor or certbot) are picked up too.
+func (m *certManager) watch() {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("unable to watch the certificate: %v", err)
+		return
+	}
+	dirs := map[string]bool{filepath.Dir(m.certPath): true, filepath.Dir(m.keyPath): true}
+	for dir := range dirs {
+		if err := w.Add(dir); err != nil {
+			log.Printf("unable to watch %v: %v", dir, err)
+		}
+	}
+	certPath, keyPath := filepath.Clean(m.certPath), filepath.Clean(m.keyPath)
+	for {
+		select {
+		case e, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			name := filepath.Clean(e.Name)
+			if (name != certPath && name != keyPath) || e.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			// the certificate and the key may not be updated at the same time, a mismatching pair is just skipped
+			if err := m.load(); err != nil {
+				log.Print(err)
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("error while watching the certificate: %v", err)
+		}
+	}
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
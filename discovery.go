@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_DISCOVERY_PATH = "/config/discovered.json"
+)
+
+// the keys of the birth certificate describing the hardware
+var birthModelKeys = []string{"model_name", "model_id", "display_name", "part_number"}
+
+// deviceDiscovery finds the catalog model of the gateways missing from Config.Devices, so they are polled
+// without any configuration. The profiles are persisted in the same format as Config.Devices: they can be
+// edited there, or copied to Config.Devices which always takes precedence.
+type deviceDiscovery struct {
+	mu      sync.Mutex
+	devices map[string]Devices
+	running map[string]bool
+}
+
+var discovery = &deviceDiscovery{devices: map[string]Devices{}, running: map[string]bool{}}
+
+func discoveryPath() string {
+	if Config.Discovery_path != "" {
+		return Config.Discovery_path
+	}
+	return DEFAULT_DISCOVERY_PATH
+}
+
+func (d *deviceDiscovery) load() {
+	b, err := os.ReadFile(discoveryPath())
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Printf("unable to read the discovered devices: %v", err)
+		return
+	}
+	var devices []Devices
+	if err := json.Unmarshal(b, &devices); err != nil {
+		log.Printf("unable to parse %v: %v", discoveryPath(), err)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, device := range devices {
+		d.devices[device.GwID] = device
+	}
+}
+
+// save writes the profiles; the caller must hold the lock.
+func (d *deviceDiscovery) save() {
+	devices := []Devices{}
+	for _, device := range d.devices {
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].GwID < devices[j].GwID })
+	b, err := json.MarshalIndent(devices, "", "    ")
+	if err != nil {
+		log.Printf("unable to encode the discovered devices: %v", err)
+		return
+	}
+	if err := writeFileAtomic(discoveryPath(), b, 0644); err != nil {
+		log.Printf("unable to save the discovered devices: %v", err)
+	}
+}
+
+// Get returns the discovered profile of the gateway.
+func (d *deviceDiscovery) Get(gwID string) (Devices, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	device, ok := d.devices[gwID]
+	return device, ok
+}
+
+// Start looks for the model of a newly connected gateway in the background, unless it is known or being
+// discovered. The device is given the time to subscribe and send its birth certificate first.
+func (d *deviceDiscovery) Start(gwID string) {
+	if _, ok := findDevice(gwID); ok {
+		return
+	}
+	d.mu.Lock()
+	if d.running[gwID] {
+		d.mu.Unlock()
+		return
+	}
+	d.running[gwID] = true
+	d.mu.Unlock()
+
+	go func() {
+		defer func() {
+			d.mu.Lock()
+			delete(d.running, gwID)
+			d.mu.Unlock()
+		}()
+		time.Sleep(POLL_CONNECT_DELAY)
+		m, how := modelFromBirth(registry.Birth(gwID)), "birth certificate"
+		if m == nil {
+			m, how = probeModel(gwID), "probing"
+		}
+		if m == nil {
+			log.Printf("unable to discover the model of %v, add it to Devices", gwID)
+			return
+		}
+		d.add(gwID, m)
+		log.Printf("discovered %v as %v (%v) by %v", gwID, m.Name, m.Description, how)
+		for _, r := range pollRequests {
+			polls.Trigger(gwID, r.name, 0)
+		}
+	}()
+}
+
+func (d *deviceDiscovery) add(gwID string, m *catalogModel) {
+	device := Devices{
+		GwID:              gwID,
+		Sys:               m.Sys,
+		WheType:           m.WheType,
+		WheModelType:      m.WheModelType,
+		Name:              registry.Birth(gwID)["display_name"],
+		ConsumptionTyp:    m.ConsumptionTyp,
+		ConsumptionOffset: m.ConsumptionOffset,
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.devices[gwID] = device
+	d.save()
+}
+
+// modelFromBirth finds the model whose Birth_models match the hardware reported in the birth certificate.
+func modelFromBirth(birth map[string]string) *catalogModel {
+	for _, m := range catalogModels() {
+		for _, pattern := range m.Birth_models {
+			for _, key := range birthModelKeys {
+				if v := birth[key]; v != "" && strings.Contains(strings.ToLower(v), strings.ToLower(pattern)) {
+					return m
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// probeModel reads the parameters of every model from the device: the one with the most keys answered wins.
+// The devices do not report the keys they do not know, so a tie means the device is none of the models.
+func probeModel(gwID string) *catalogModel {
+	models := catalogModels()
+	keys := []string{}
+	for _, m := range models {
+		keys = append(keys, m.PollKeys()...)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	msg, err := reads.Read(gwID, keys)
+	if err != nil {
+		log.Printf("unable to probe %v: %v", gwID, err)
+		return nil
+	}
+	params, _ := parseParams(msg)
+	var best *catalogModel
+	bestScore, tie := 0, false
+	for _, m := range models {
+		score := 0
+		for _, key := range m.PollKeys() {
+			if _, ok := params[key]; ok {
+				score++
+			}
+		}
+		switch {
+		case score > bestScore:
+			best, bestScore, tie = m, score, false
+		case score == bestScore && score > 0:
+			tie = true
+		}
+	}
+	if tie {
+		return nil
+	}
+	return best
+}
+
+func discoveryLogic() {
+	discovery.load()
+}
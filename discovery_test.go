@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+)
+
+// No birth certificate of a real device is available, these ones are made up: the test pins the matching rules
+// of Birth_models, not what the devices actually report.
+
+func TestModelFromBirth(t *testing.T) {
+	// only the built-in models, whatever is in the default Catalog_path
+	Config.Catalog_path = t.TempDir()
+	defer func() { Config.Catalog_path = "" }()
+	loadCatalog()
+
+	for _, tc := range []struct {
+		birth map[string]string
+		model string
+	}{
+		{map[string]string{"display_name": "Lydos Hybrid", "model_name": "LYDOS HYBRID 100"}, "se"},
+		{map[string]string{"display_name": "Velis Lux", "model_name": "VELIS LUX WIFI 80"}, "med"},
+		{map[string]string{"model_name": "VELIS LUX WIFI 80"}, "med"},
+		// the Evo family is not supported yet
+		{map[string]string{"display_name": "Velis Evo", "model_name": "VELIS EVO WIFI 80"}, ""},
+		{map[string]string{"display_name": "Nuos Plus", "serial_number": "A1"}, ""},
+	} {
+		m := modelFromBirth(tc.birth)
+		if m == nil {
+			if tc.model != "" {
+				t.Errorf("%v: no model found, want %v", tc.birth, tc.model)
+			}
+			continue
+		}
+		if m.Name != tc.model {
+			t.Errorf("%v: got %v, want %q", tc.birth, m.Name, tc.model)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/irsl/broker-ari/arimsgs"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	EVENT_PARAMS      = "params"
+	EVENT_CONSUMPTION = "consumption"
+	EVENT_ERRORS      = "errors"
+	EVENT_BIRTH       = "birth"
+	EVENT_CONNECT     = "connect"
+	EVENT_DISCONNECT  = "disconnect"
+
+	EVENT_BUFFER_SIZE     = 64
+	EVENT_KEEPALIVE_DELAY = 30 * time.Second
+)
+
+// event is pushed to the subscribers of /api/v1/events whenever a device reports something new.
+type event struct {
+	Id   int64     `json:"id"`
+	Type string    `json:"type"`
+	Gw   string    `json:"gw"`
+	Time time.Time `json:"time"`
+	Data any       `json:"data,omitempty"`
+}
+
+type eventSubscriber struct {
+	ch       chan event
+	gateways []string // empty means all
+	types    []string // empty means all
+}
+
+// eventBus fans the events out to the subscribers. Publishing never blocks the MQTT hooks: a subscriber
+// that does not keep up is dropped, its client reconnects and fetches the current state again.
+type eventBus struct {
+	next atomic.Int64
+
+	mu          sync.Mutex
+	subscribers map[*eventSubscriber]bool
+}
+
+var events = &eventBus{subscribers: map[*eventSubscriber]bool{}}
+
+func (b *eventBus) Subscribe(gateways, types []string) *eventSubscriber {
+	s := &eventSubscriber{ch: make(chan event, EVENT_BUFFER_SIZE), gateways: gateways, types: types}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers[s] = true
+	return s
+}
+
+func (b *eventBus) Unsubscribe(s *eventSubscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subscribers[s] {
+		delete(b.subscribers, s)
+		close(s.ch)
+	}
+}
+
+func (b *eventBus) Publish(clID, typ string, data any) {
+	e := event{Id: b.next.Add(1), Type: typ, Gw: clID, Time: time.Now().UTC(), Data: data}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subscribers {
+		if (len(s.gateways) > 0 && !slices.Contains(s.gateways, clID)) || (len(s.types) > 0 && !slices.Contains(s.types, typ)) {
+			continue
+		}
+		select {
+		case s.ch <- e:
+		default:
+			log.Printf("dropping a slow event subscriber")
+			delete(b.subscribers, s)
+			close(s.ch)
+		}
+	}
+}
+
+// ParamsChanged publishes the parameters that differ from the previously known values.
+func (b *eventBus) ParamsChanged(clID string, old, params map[string]int32) {
+	changed := map[string]int32{}
+	for key, value := range params {
+		if previous, ok := old[key]; !ok || previous != value {
+			changed[key] = value
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+	b.Publish(clID, EVENT_PARAMS, paramViews(clID, changed, registry.Limits(clID)))
+}
+
+// ConsumptionChanged publishes the consumption report if it differs from the previous one.
+func (b *eventBus) ConsumptionChanged(clID string, old, cWh *arimsgs.ConsumptionMsg) {
+	if old != nil && proto.Equal(old.GetConsumptions(), cWh.GetConsumptions()) {
+		return
+	}
+	b.Publish(clID, EVENT_CONSUMPTION, consumptionEntries(clID, cWh))
+}
+
+// ErrorsChanged publishes the active faults if the list differs from the previous one.
+func (b *eventBus) ErrorsChanged(clID string, old, errors *arimsgs.ParametersMsg) {
+	codes := func(faults []fault) []string {
+		re := []string{}
+		for _, f := range faults {
+			re = append(re, f.Code)
+		}
+		slices.Sort(re)
+		return re
+	}
+	active := parseErrorList(clID, errors)
+	if old != nil && slices.Equal(codes(parseErrorList(clID, old)), codes(active)) {
+		return
+	}
+	re := []map[string]any{}
+	for _, f := range active {
+		re = append(re, map[string]any{"code": f.Code, "description": f.Description, "severity": f.Severity})
+	}
+	b.Publish(clID, EVENT_ERRORS, re)
+}
+
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// eventsV1 serves GET /api/v1/events[?gw=a,b][&types=params,errors] as a stream of Server-Sent Events.
+// EventSource cannot set headers, so the token can be passed as ?token= as well.
+func eventsV1(w http.ResponseWriter, req *http.Request) {
+	if token := req.URL.Query().Get("token"); token != "" && requestToken(req) == "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	s, e := authorize(req, API_SCOPE_READ)
+	if e != nil {
+		http.Error(w, e.Message, e.status)
+		return
+	}
+	if req.Method != http.MethodGet {
+		http.Error(w, "unsupported method "+req.Method, http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	gateways := splitList(req.URL.Query().Get("gw"))
+	if len(s.Gateways) > 0 {
+		if len(gateways) == 0 {
+			gateways = s.Gateways
+		}
+		gateways = slices.DeleteFunc(gateways, func(gw string) bool { return !s.canAccess(gw) })
+		if len(gateways) == 0 {
+			http.Error(w, "no access to the requested gateways", http.StatusForbidden)
+			return
+		}
+	}
+	sub := events.Subscribe(gateways, splitList(req.URL.Query().Get("types")))
+	defer events.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	keepalive := time.NewTicker(EVENT_KEEPALIVE_DELAY)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case e, ok := <-sub.ch:
+			if !ok {
+				return
+			}
+			b, err := json.Marshal(e)
+			if err != nil {
+				log.Printf("unable to encode the event: %v", err)
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %v\ndata: %s\n\n", e.Id, e.Type, b)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/irsl/broker-ari/arimsgs"
+)
+
+const (
+	FAULT_HISTORY_SIZE = 100
+)
+
+// fault is an entry of the error list reported by the device.
+type fault struct {
+	Code        string
+	Description string
+	Severity    int32
+	Timestamp   time.Time
+}
+
+// faultEvent records when a fault appeared and when it was cleared.
+type faultEvent struct {
+	Code        string     `json:"code"`
+	Description string     `json:"description"`
+	Severity    int32      `json:"severity"`
+	Appeared    time.Time  `json:"appeared"`
+	Cleared     *time.Time `json:"cleared"`
+}
+
+type faultHistory struct {
+	mu     sync.Mutex
+	events map[string][]faultEvent
+}
+
+var faults = &faultHistory{events: map[string][]faultEvent{}}
+
+// parseErrorList decodes the error list. The layout of the message is not documented and no capture of it is
+// available yet: every parameter (besides the request metadata) is taken as an active fault, the key is its
+// code and the value is either the description or the severity. The catalog model of the device can provide
+// the missing description and severity. Until the layout is confirmed, the result is only served with
+// Error_list_decoding.
+func parseErrorList(clID string, msg *arimsgs.ParametersMsg) []fault {
+	re := []fault{}
+	if msg == nil {
+		return re
+	}
+	m := deviceModel(clID)
+	ts := time.Unix(0, msg.Timestamp)
+	for _, p := range msg.Params {
+		if p.Key == "requester.client.id" || p.Key == "request.id" {
+			continue
+		}
+		f := fault{Code: p.Key, Timestamp: ts}
+		switch v := p.Value.(type) {
+		case *arimsgs.Parameter_ValueS:
+			f.Description = v.ValueS
+		case *arimsgs.Parameter_ValueI:
+			f.Severity = v.ValueI
+		}
+		if m != nil {
+			if e, ok := m.Errors[f.Code]; ok {
+				if f.Description == "" {
+					f.Description = e.Description
+				}
+				if f.Severity == 0 {
+					f.Severity = e.Severity
+				}
+			}
+		}
+		re = append(re, f)
+	}
+	return re
+}
+
+// Record updates the history of the device with the currently active faults, and saves it to the state store.
+func (h *faultHistory) Record(clID string, active []fault) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	events := h.events[clID]
+	isActive := map[string]bool{}
+	for _, f := range active {
+		isActive[f.Code] = true
+	}
+	open := map[string]bool{}
+	for i := range events {
+		if events[i].Cleared != nil {
+			continue
+		}
+		if isActive[events[i].Code] {
+			open[events[i].Code] = true
+		} else {
+			events[i].Cleared = &now
+		}
+	}
+	for _, f := range active {
+		if open[f.Code] {
+			continue
+		}
+		appeared := f.Timestamp
+		if appeared.Unix() <= 0 {
+			appeared = now
+		}
+		events = append(events, faultEvent{Code: f.Code, Description: f.Description, Severity: f.Severity, Appeared: appeared})
+	}
+	if len(events) > FAULT_HISTORY_SIZE {
+		events = events[len(events)-FAULT_HISTORY_SIZE:]
+	}
+	h.events[clID] = events
+
+	if store != nil {
+		b, err := json.Marshal(events)
+		if err != nil {
+			log.Printf("unable to encode the fault history of %v: %v", clID, err)
+			return
+		}
+		store.Save(clID, STORE_FAULTS, b)
+	}
+}
+
+// Load restores the history of the device saved by Record.
+func (h *faultHistory) Load(clID string, payload []byte) {
+	var events []faultEvent
+	if err := json.Unmarshal(payload, &events); err != nil {
+		log.Printf("unable to decode the fault history of %v: %v", clID, err)
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events[clID] = events
+}
+
+// Get returns the history of the device, oldest first.
+func (h *faultHistory) Get(clID string) []faultEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]faultEvent{}, h.events[clID]...)
+}
+
+// busErrorEntry converts the fault to the format of the official API.
+func busErrorEntry(clID string, f fault) map[string]any {
+	code, _ := strconv.Atoi(f.Code)
+	return map[string]any{
+		"gw":        clID,
+		"timestamp": f.Timestamp.UTC().Format(time.RFC3339),
+		"fault":     code,
+		"mult":      0,
+		"code":      f.Code,
+		"pri":       f.Severity,
+		"errDex":    f.Description,
+		"res":       false,
+		"blk":       false,
+	}
+}
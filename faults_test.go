@@ -0,0 +1,117 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/irsl/broker-ari/arimsgs"
+	bolt "go.etcd.io/bbolt"
+)
+
+// No capture of ErrListRst is available, so the layout is an assumption (see parseErrorList): these tests pin
+// the decoding rules and the output format, not the messages of real devices.
+
+func stringParam(key, value string) *arimsgs.Parameter {
+	return &arimsgs.Parameter{Key: key, Value: &arimsgs.Parameter_ValueS{ValueS: value}}
+}
+
+func intParam(key string, value int32) *arimsgs.Parameter {
+	return &arimsgs.Parameter{Key: key, Value: &arimsgs.Parameter_ValueI{ValueI: value}}
+}
+
+func TestParseErrorList(t *testing.T) {
+	oldCatalog, oldDevices := catalog, Config.Devices
+	defer func() { catalog, Config.Devices = oldCatalog, oldDevices }()
+	catalog = map[string]*catalogModel{"test": {Name: "test", Sys: 4, WheType: 99, Errors: map[string]catalogError{
+		"501": {Description: "No flame", Severity: 2},
+		"502": {Description: "Sensor", Severity: 1},
+	}}}
+	Config.Devices = []Devices{{GwID: "GW1", Sys: 4, WheType: 99}}
+
+	ts := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	faults := parseErrorList("GW1", &arimsgs.ParametersMsg{Timestamp: ts.UnixNano(), Params: []*arimsgs.Parameter{
+		stringParam("requester.client.id", "inline"),
+		stringParam("request.id", "errors"),
+		intParam("501", 3),
+		stringParam("502", "Sensor fault"),
+		intParam("777", 0),
+	}})
+	want := []fault{
+		{Code: "501", Description: "No flame", Severity: 3, Timestamp: ts},
+		{Code: "502", Description: "Sensor fault", Severity: 1, Timestamp: ts},
+		{Code: "777", Timestamp: ts},
+	}
+	if len(faults) != len(want) {
+		t.Fatalf("got %+v, want %+v", faults, want)
+	}
+	for i := range want {
+		got := faults[i]
+		if got.Code != want[i].Code || got.Description != want[i].Description || got.Severity != want[i].Severity ||
+			!got.Timestamp.Equal(want[i].Timestamp) {
+			t.Errorf("fault %d: got %+v, want %+v", i, faults[i], want[i])
+		}
+	}
+
+	if got := parseErrorList("GW1", nil); len(got) != 0 {
+		t.Errorf("no message: got %+v", got)
+	}
+}
+
+func TestBusErrorEntry(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 10, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+	e := busErrorEntry("GW1", fault{Code: "501", Description: "No flame", Severity: 3, Timestamp: ts})
+	want := map[string]any{
+		"gw":        "GW1",
+		"timestamp": "2024-05-01T08:00:00Z",
+		"fault":     501,
+		"mult":      0,
+		"code":      "501",
+		"pri":       int32(3),
+		"errDex":    "No flame",
+		"res":       false,
+		"blk":       false,
+	}
+	for k, v := range want {
+		if e[k] != v {
+			t.Errorf("%v: got %#v, want %#v", k, e[k], v)
+		}
+	}
+	if len(e) != len(want) {
+		t.Errorf("got %v fields, want %v: %v", len(e), len(want), e)
+	}
+}
+
+func TestFaultHistoryIsPersisted(t *testing.T) {
+	s, err := openStateStore(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.db.Close()
+	oldStore := store
+	store = s
+	defer func() { store = oldStore }()
+
+	h := &faultHistory{events: map[string][]faultEvent{}}
+	h.Record("GW1", []fault{{Code: "501"}, {Code: "502"}})
+	h.Record("GW1", []fault{{Code: "502"}})
+
+	restored := &faultHistory{events: map[string][]faultEvent{}}
+	err = s.db.View(func(tx *bolt.Tx) error {
+		restored.Load("GW1", tx.Bucket(devicesBucket).Bucket([]byte("GW1")).Get([]byte(STORE_FAULTS)))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := restored.Get("GW1")
+	if len(events) != 2 {
+		t.Fatalf("got %+v", events)
+	}
+	if events[0].Code != "501" || events[0].Cleared == nil {
+		t.Errorf("501 should be cleared: %+v", events[0])
+	}
+	if events[1].Code != "502" || events[1].Cleared != nil {
+		t.Errorf("502 should be active: %+v", events[1])
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"net/http"
+	URL "net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	HISTORY_DEFAULT_RANGE = 24 * time.Hour
+)
+
+var historyBucket = []byte("history")
+
+// The history is kept in the state store: a bucket per gateway, the keys are the big endian unix nano
+// timestamp followed by the parameter key, the values are the raw parameter values.
+
+func historyKey(ts time.Time, key string) []byte {
+	k := make([]byte, 8, 8+len(key))
+	binary.BigEndian.PutUint64(k, uint64(ts.UnixNano()))
+	return append(k, key...)
+}
+
+func historyEnabled() bool {
+	return store != nil && Config.History_retention_days > 0
+}
+
+// recordHistory appends the parameters read from the device to its history.
+func recordHistory(clID string, params map[string]int32) {
+	if !historyEnabled() {
+		return
+	}
+	now := time.Now()
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		h, err := tx.CreateBucketIfNotExists(historyBucket)
+		if err != nil {
+			return err
+		}
+		b, err := h.CreateBucketIfNotExists([]byte(clID))
+		if err != nil {
+			return err
+		}
+		for key, value := range params {
+			v := make([]byte, 4)
+			binary.BigEndian.PutUint32(v, uint32(value))
+			if err := b.Put(historyKey(now, key), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("unable to record the history of %v: %v", clID, err)
+	}
+}
+
+// pruneHistory drops the values older than the retention.
+func pruneHistory() {
+	limit := historyKey(time.Now().AddDate(0, 0, -Config.History_retention_days), "")
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		h := tx.Bucket(historyBucket)
+		if h == nil {
+			return nil
+		}
+		return h.ForEachBucket(func(gw []byte) error {
+			c := h.Bucket(gw).Cursor()
+			for k, _ := c.First(); k != nil && bytes.Compare(k, limit) < 0; k, _ = c.Next() {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("unable to prune the history: %v", err)
+	}
+}
+
+type historyPoint struct {
+	T time.Time `json:"t"`
+	V float64   `json:"v"`
+}
+
+// queryHistory returns the values of the keys between from and to. If step is not zero, the values are
+// averaged in step long buckets.
+func queryHistory(clID string, keys []string, from, to time.Time, step time.Duration) (map[string][]historyPoint, error) {
+	wanted := map[string]string{}
+	re := map[string][]historyPoint{}
+	for _, name := range keys {
+		wanted[lookupParam(clID, name).Key] = name
+		re[name] = []historyPoint{}
+	}
+
+	type bucket struct {
+		sum   float64
+		count int
+	}
+	buckets := map[string]map[int64]*bucket{}
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		h := tx.Bucket(historyBucket)
+		if h == nil {
+			return nil
+		}
+		b := h.Bucket([]byte(clID))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		end := historyKey(to, "\xff")
+		for k, v := c.Seek(historyKey(from, "")); k != nil && bytes.Compare(k, end) <= 0; k, v = c.Next() {
+			name, ok := wanted[string(k[8:])]
+			if !ok || len(v) != 4 {
+				continue
+			}
+			ts := time.Unix(0, int64(binary.BigEndian.Uint64(k[:8])))
+			p := lookupParam(clID, string(k[8:]))
+			value := float64(int32(binary.BigEndian.Uint32(v))) / float64(p.Scale)
+			if step == 0 {
+				re[name] = append(re[name], historyPoint{T: ts.UTC(), V: value})
+				continue
+			}
+			slot := ts.Sub(from).Nanoseconds() / step.Nanoseconds()
+			if buckets[name] == nil {
+				buckets[name] = map[int64]*bucket{}
+			}
+			if buckets[name][slot] == nil {
+				buckets[name][slot] = &bucket{}
+			}
+			buckets[name][slot].sum += value
+			buckets[name][slot].count++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if step != 0 {
+		for name, slots := range buckets {
+			ids := make([]int64, 0, len(slots))
+			for slot := range slots {
+				ids = append(ids, slot)
+			}
+			sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+			for _, slot := range ids {
+				b := slots[slot]
+				re[name] = append(re[name], historyPoint{T: from.Add(time.Duration(slot) * step).UTC(), V: b.sum / float64(b.count)})
+			}
+		}
+	}
+	return re, nil
+}
+
+// parseHistoryTime accepts RFC 3339 timestamps and unix seconds.
+func parseHistoryTime(s string, def time.Time) (time.Time, bool) {
+	if s == "" {
+		return def, true
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, true
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0), true
+	}
+	return time.Time{}, false
+}
+
+// parseHistoryStep accepts durations (e.g. 5m) and seconds; steps are rounded to seconds.
+func parseHistoryStep(s string) (time.Duration, bool) {
+	if s == "" {
+		return 0, true
+	}
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+		return time.Duration(n) * time.Second, true
+	}
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return d.Round(time.Second), true
+	}
+	return 0, false
+}
+
+// history serves GET /history/<gw>?keys=T_18.3.3,reqTemp&from=..&to=..&step=..
+func history(path string, body any, params URL.Values, method string) any {
+	if !historyEnabled() {
+		return newAPIError(http.StatusNotFound, "history is disabled")
+	}
+	v := strings.Split(path, "/")
+	if len(v) != 3 || v[2] == "" {
+		return newAPIError(http.StatusBadRequest, "missing gateway id")
+	}
+	clID := v[2]
+
+	to, ok := parseHistoryTime(params.Get("to"), time.Now())
+	if !ok {
+		return newAPIError(http.StatusBadRequest, "invalid to")
+	}
+	from, ok := parseHistoryTime(params.Get("from"), to.Add(-HISTORY_DEFAULT_RANGE))
+	if !ok {
+		return newAPIError(http.StatusBadRequest, "invalid from")
+	}
+	if from.After(to) {
+		return newAPIError(http.StatusBadRequest, "from is after to")
+	}
+	step, ok := parseHistoryStep(params.Get("step"))
+	if !ok {
+		return newAPIError(http.StatusBadRequest, "invalid step")
+	}
+	keys := []string{}
+	for _, k := range strings.Split(params.Get("keys"), ",") {
+		if k != "" {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return newAPIError(http.StatusBadRequest, "missing keys")
+	}
+
+	series, err := queryHistory(clID, keys, from, to, step)
+	if err != nil {
+		log.Printf("unable to query the history of %v: %v", clID, err)
+		return newAPIError(http.StatusInternalServerError, "unable to query the history: %v", err)
+	}
+	return map[string]any{
+		"gw":     clID,
+		"from":   from.UTC().Format(time.RFC3339),
+		"to":     to.UTC().Format(time.RFC3339),
+		"step":   step.Seconds(),
+		"series": series,
+	}
+}
+
+func historyLogic() {
+	if !historyEnabled() {
+		return
+	}
+	go func() {
+		for {
+			pruneHistory()
+			time.Sleep(time.Hour)
+		}
+	}()
+}
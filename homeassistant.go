@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+)
+
+const (
+	HA_DEFAULT_DISCOVERY_PREFIX = "homeassistant"
+)
+
+var (
+	haPublisher publisher
+	haAnnounced sync.Map
+)
+
+func ha_log_Printf(t string, params ...any) {
+	if !Config.Mqtt_debug {
+		return
+	}
+	log.Printf(t, params...)
+}
+
+func haDiscoveryPrefix() string {
+	if Config.Homeassistant_discovery_prefix == "" {
+		return HA_DEFAULT_DISCOVERY_PREFIX
+	}
+	return Config.Homeassistant_discovery_prefix
+}
+
+// haAnnounce publishes the discovery configs of the device; the error of the last failed publish is returned.
+func haAnnounce(clID string, device Devices, m *catalogModel) error {
+	birth := registry.Birth(clID)
+	limits := registry.Limits(clID)
+
+	name := device.Name
+	if name == "" {
+		name = clID
+	}
+	dev := map[string]any{
+		"identifiers":   []string{clID},
+		"name":          name,
+		"manufacturer":  "Ariston",
+		"sw_version":    birth["firmware_version"],
+		"serial_number": birth["serial_number"],
+	}
+	base := func(id, name string) map[string]any {
+		return map[string]any{
+			"name":               name,
+			"unique_id":          clID + "_" + id,
+			"object_id":          clID + "_" + id,
+			"device":             dev,
+			"availability_topic": stateTopic(clID, "availability"),
+		}
+	}
+
+	configs := map[string]map[string]any{}
+
+	wh := base("water_heater", "Water heater")
+	wh["current_temperature_topic"] = stateTopic(clID, "state")
+	wh["current_temperature_template"] = "{{ value_json.temp }}"
+	wh["temperature_state_topic"] = stateTopic(clID, "state")
+	wh["temperature_state_template"] = "{{ value_json.reqTemp }}"
+	wh["temperature_command_topic"] = stateTopic(clID, "set", "reqTemp")
+	wh["mode_state_topic"] = stateTopic(clID, "state")
+	wh["mode_state_template"] = "{{ 'performance' if value_json.on else 'off' }}"
+	wh["mode_command_topic"] = stateTopic(clID, "set", "on")
+	wh["mode_command_template"] = "{{ 0 if value == 'off' else 1 }}"
+	wh["modes"] = []string{"off", "performance"}
+	wh["temperature_unit"] = "C"
+	wh["precision"] = 0.1
+	reqTemp := lookupParam(clID, "reqTemp")
+	if l, ok := limits[reqTemp.Key]; ok {
+		wh["min_temp"] = scaleValue(l.Min, reqTemp.Scale)
+		wh["max_temp"] = scaleValue(l.Max, reqTemp.Scale)
+	}
+	configs["water_heater/"+clID+"/water_heater"] = wh
+
+	for _, e := range m.Params {
+		if e.Ha == "" || e.Ha == "water_heater" {
+			continue
+		}
+		c := base(e.Id, e.Name)
+		c["state_topic"] = stateTopic(clID, "state")
+		c["value_template"] = "{{ value_json." + e.Id + " }}"
+		if e.Unit != "" {
+			c["unit_of_measurement"] = e.Unit
+		}
+		if e.Ha_device_class != "" {
+			c["device_class"] = e.Ha_device_class
+		}
+		switch e.Ha {
+		case "switch":
+			c["command_topic"] = stateTopic(clID, "set", e.Id)
+			c["payload_on"] = "1"
+			c["payload_off"] = "0"
+			c["state_on"] = "1"
+			c["state_off"] = "0"
+		case "number":
+			c["command_topic"] = stateTopic(clID, "set", e.Id)
+			c["mode"] = "box"
+			c["step"] = 1 / float64(e.Scale)
+			if l, ok := limits[e.Key]; ok {
+				c["min"] = scaleValue(l.Min, e.Scale)
+				c["max"] = scaleValue(l.Max, e.Scale)
+			}
+		}
+		configs[e.Ha+"/"+clID+"/"+e.Id] = c
+	}
+
+	var failed error
+	for topic, c := range configs {
+		b, err := json.Marshal(c)
+		if err != nil {
+			ha_log_Printf("unable to marshal discovery config %v: %v", topic, err)
+			continue
+		}
+		if err := haPublisher.Publish(haDiscoveryPrefix()+"/"+topic+"/config", b, true); err != nil {
+			ha_log_Printf("unable to publish discovery config %v: %v", topic, err)
+			failed = err
+		}
+	}
+	return failed
+}
+
+// haAnnounceOnce publishes the discovery configs of the device, once per run; a failed announcement is
+// retried on the next call.
+func haAnnounceOnce(clID string) {
+	if haPublisher == nil {
+		return
+	}
+	device, ok := findDevice(clID)
+	if !ok {
+		return
+	}
+	m := findModel(device)
+	if m == nil {
+		return
+	}
+	if _, announced := haAnnounced.LoadOrStore(clID, true); !announced {
+		if err := haAnnounce(clID, device, m); err != nil {
+			haAnnounced.Delete(clID)
+		}
+	}
+}
+
+func homeassistantLogic() {
+	if !Config.Homeassistant_discovery {
+		return
+	}
+
+	if Config.Homeassistant_mqtt_broker == "" {
+		haPublisher = getLocalPublisher()
+	} else {
+		haPublisher = newExternalPublisher(Config.Homeassistant_mqtt_broker, "broker-ari",
+			Config.Homeassistant_mqtt_username, Config.Homeassistant_mqtt_password)
+		addStatePublisher(haPublisher)
+	}
+}
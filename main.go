@@ -13,21 +13,56 @@ import (
 type config struct {
 	Api_debug                    bool
 	Api_listener                 string
+	Api_tls_listener             string
+	Api_certificate_path         string
+	Api_private_key_path         string
+	Api_client_ca_path           string
 	Api_password                 string
 	Api_username                 string
+	Api_users                    []ApiUser
+	Api_token_ttl                int
+	Metrics_listener             string
 	Dns_listener                 string
 	Dns_resolve_to               string
 	Ntp_resolve_to               string
 	Mqtt_debug                   bool
+	Mqtt_capture_path            string
 	Mqtt_broker_certificate_path string
 	Mqtt_broker_clear_listener   string
+	Mqtt_clear_integrations      bool // anonymous clients of the clear text listener are integrations, not devices
 	Mqtt_broker_private_key_path string
 	Mqtt_broker_tls_listener     string
 	Mqtt_proxy_upstream          string
+	Mqtt_proxy_mode              string
+	Relay_rules                  []RelayRule
+	Upstream_queue_size          int
+	Mqtt_users                   []MqttUser
+	Mqtt_device_credentials      bool // only accept the devices with Username/Password in Devices
 	Parser_debug                 bool
 	Poll_frequency               int
 	Consumption_poll_frequency   int
+	Error_poll_frequency         int
+	Error_list_decoding          bool // serve the decoded error list on /busErrors, the layout is not confirmed yet
+	Write_timeout                int
 	Devices                      []Devices
+	Discovery_path               string
+	Catalog_path                 string
+	State_db_path                string
+	History_retention_days       int
+
+	Mqtt_state_topics              bool
+	Homeassistant_discovery        bool
+	Homeassistant_discovery_prefix string
+	Homeassistant_mqtt_broker      string
+	Homeassistant_mqtt_username    string
+	Homeassistant_mqtt_password    string
+
+	Upstream_tls_ca_path              string
+	Upstream_tls_server_name          string
+	Upstream_tls_certificate_path     string
+	Upstream_tls_private_key_path     string
+	Upstream_tls_fingerprints         []string
+	Upstream_tls_insecure_skip_verify bool
 }
 
 type Devices struct {
@@ -38,11 +73,34 @@ type Devices struct {
 	Name              string
 	ConsumptionTyp    string
 	ConsumptionOffset int
+	PollFrequency     int    // overrides Poll_frequency for this device
+	ProxyMode         string // overrides Mqtt_proxy_mode for this device
+	Username          string // the credentials the device has to connect with, not checked if both are empty
+	Password          string
 }
 
 var Config config
 
+// findDevice returns the configuration of the gateway, or its discovered profile. The entries without a GwID
+// (e.g. the templates of the sample config) never match.
+func findDevice(gwID string) (Devices, bool) {
+	if gwID == "" {
+		return Devices{}, false
+	}
+	for _, device := range Config.Devices {
+		if device.GwID == gwID {
+			return device, true
+		}
+	}
+	return discovery.Get(gwID)
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		replayCommand(os.Args[2:])
+		return
+	}
+
 	file, err := os.OpenFile("/config/broker-ari.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
 	if err != nil {
 		log.Fatal(err)
@@ -76,7 +134,14 @@ func main() {
 		done <- true
 	}()
 
+	loadCatalog()
+	discoveryLogic()
+	storeLogic()
+	historyLogic()
 	mqttLogic()
+	stateLogic()
+	homeassistantLogic()
+	metricsLogic()
 	apiLogic()
 	dnsLogic()
 
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	metricPublishes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "broker_ari_mqtt_publish_total",
+		Help: "Messages published on the local broker, by topic suffix.",
+	}, []string{"suffix"})
+	metricParseFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "broker_ari_parse_failures_total",
+		Help: "Messages that could not be decoded.",
+	}, []string{"message"})
+	metricPollLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "broker_ari_poll_duration_seconds",
+		Help:    "Time between a poll request and the reply of the device.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"request"})
+
+	pollStarted sync.Map
+)
+
+// the replies keeping their own label, the other replies are addressed to request IDs (e.g. the random IDs of
+// the vendor app) and would make the cardinality of the metrics unbounded
+var metricReplies = map[string]bool{"params": true, "verify": true, "result": true, "consumptions": true}
+
+// topicSuffix returns the part of the topic after the client ID and the application, e.g. REPLY/params
+// for $EDC/ari/<gw>/ar1/REPLY/params. The replies to other requests are all REPLY/other.
+func topicSuffix(topic string) string {
+	v := strings.Split(strings.TrimPrefix(topic, "$EDC/"), "/")
+	if len(v) < 4 || v[0] != "ari" {
+		return "other"
+	}
+	if v[3] == "REPLY" && (len(v) != 5 || !metricReplies[v[4]]) {
+		return "REPLY/other"
+	}
+	return strings.Join(v[3:], "/")
+}
+
+// pollSent records the time a request was sent to the device, so the latency can be measured when the reply arrives.
+func pollSent(clID, request string) {
+	pollStarted.Store(clID+"/"+request, time.Now())
+}
+
+func pollReplied(clID, request string) {
+	if t, ok := pollStarted.LoadAndDelete(clID + "/" + request); ok {
+		metricPollLatency.WithLabelValues(request).Observe(time.Since(t.(time.Time)).Seconds())
+	}
+}
+
+// deviceCollector exports the state of the devices and the broker at scrape time.
+type deviceCollector struct{}
+
+var (
+	descParam = prometheus.NewDesc("broker_ari_param_value",
+		"Value of a device parameter, scaled.", []string{"gw", "key", "name"}, nil)
+	descConsumption = prometheus.NewDesc("broker_ari_consumption_wh",
+		"Energy consumption reported by the device, per period slot.", []string{"gw", "type", "period", "slot"}, nil)
+	descConnected = prometheus.NewDesc("broker_ari_device_connected",
+		"Whether the device has a session on the local broker.", []string{"gw"}, nil)
+	descUpstream = prometheus.NewDesc("broker_ari_upstream_connected",
+		"Whether the connection of the device to the upstream broker is up.", []string{"gw"}, nil)
+	descClients = prometheus.NewDesc("broker_ari_mqtt_clients_connected",
+		"Clients connected to the local broker.", nil, nil)
+)
+
+func (c deviceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- descParam
+	ch <- descConsumption
+	ch <- descConnected
+	ch <- descUpstream
+	ch <- descClients
+}
+
+func (c deviceCollector) Collect(ch chan<- prometheus.Metric) {
+	if server != nil {
+		ch <- prometheus.MustNewConstMetric(descClients, prometheus.GaugeValue, float64(atomic.LoadInt64(&server.Info.ClientsConnected)))
+	}
+	for _, clID := range registry.IDs() {
+		d, ok := registry.Get(clID)
+		if !ok {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(descConnected, prometheus.GaugeValue, boolValue(d.connected), clID)
+		if d.client != nil {
+			ch <- prometheus.MustNewConstMetric(descUpstream, prometheus.GaugeValue, boolValue(d.client.IsConnected()), clID)
+		}
+		for key, value := range d.params {
+			p := lookupParam(clID, key)
+			ch <- prometheus.MustNewConstMetric(descParam, prometheus.GaugeValue, float64(value)/float64(p.Scale), clID, key, p.Id)
+		}
+		if d.cWh != nil {
+			for _, cons := range d.cWh.GetConsumptions().GetConsumptions() {
+				for i, wh := range cons.Wh {
+					ch <- prometheus.MustNewConstMetric(descConsumption, prometheus.GaugeValue, float64(wh), clID,
+						strconv.Itoa(int(cons.ConsumptionType)), strconv.Itoa(int(cons.ConsumptionTimeInterval)), strconv.Itoa(i))
+				}
+			}
+		}
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// gatewayGatherer drops the metrics of the gateways the session may not access.
+func gatewayGatherer(s apiSession) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := prometheus.DefaultGatherer.Gather()
+		if len(s.Gateways) == 0 {
+			return families, err
+		}
+		re := []*dto.MetricFamily{}
+		for _, f := range families {
+			metrics := []*dto.Metric{}
+			for _, m := range f.Metric {
+				allowed := true
+				for _, l := range m.Label {
+					if l.GetName() == "gw" && !s.canAccess(l.GetValue()) {
+						allowed = false
+					}
+				}
+				if allowed {
+					metrics = append(metrics, m)
+				}
+			}
+			if len(metrics) > 0 {
+				f.Metric = metrics
+				re = append(re, f)
+			}
+		}
+		return re, err
+	})
+}
+
+// metricsV1 serves /metrics on the API listener to the sessions with the read scope, with the metrics of the
+// gateways they may access.
+func metricsV1(w http.ResponseWriter, req *http.Request) {
+	s, e := authorize(req, API_SCOPE_READ)
+	if e != nil {
+		http.Error(w, e.Message, e.status)
+		return
+	}
+	promhttp.HandlerFor(gatewayGatherer(s), promhttp.HandlerOpts{}).ServeHTTP(w, req)
+}
+
+func metricsLogic() {
+	prometheus.MustRegister(deviceCollector{})
+
+	if Config.Metrics_listener == "" {
+		// served by the API server, with authentication
+		http.HandleFunc("/metrics", metricsV1)
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		log.Printf("Metrics server listening on %v", Config.Metrics_listener)
+		if err := http.ListenAndServe(Config.Metrics_listener, mux); err != nil {
+			log.Fatal(err)
+		}
+	}()
+}
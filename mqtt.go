@@ -4,11 +4,11 @@ import (
 	"bytes"
 	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"log"
 	"strings"
 	"time"
 
-	mqttc "github.com/eclipse/paho.mqtt.golang"
 	"github.com/irsl/broker-ari/arimsgs"
 	mqtts "github.com/mochi-mqtt/server/v2"
 	"github.com/mochi-mqtt/server/v2/hooks/auth"
@@ -21,15 +21,17 @@ const (
 )
 
 var (
-	clientMap = map[string]mqttClient{}
-	server    *mqtts.Server
+	server *mqtts.Server
 )
 
 type mqttClient struct {
-	client       mqttc.Client
+	client       *upstreamLink
+	connected    bool
+	stale        bool      // the state is not up to date: the device is disconnected or it was loaded from disk
+	updated      time.Time // when the params were last read
 	birth        map[string]string
 	params       map[string]int32
-	paramsLimits map[string]arimsgs.ParameterLimit
+	paramsLimits map[string]paramLimit
 	cWh          *arimsgs.ConsumptionMsg
 	errors       *arimsgs.ParametersMsg
 }
@@ -57,52 +59,73 @@ func (h *AuthHook) OnPacketRead(cl *mqtts.Client, pk packets.Packet) (packets.Pa
 }
 func (h *AuthHook) OnACLCheck(cl *mqtts.Client, topic string, write bool) bool {
 	mqtt_log_Printf("OnACLCheck: topic: %v, write: %v", topic, write)
+	if !checkACL(cl, topic, write) {
+		log.Printf("access denied for %v (%v): topic: %v, write: %v", cl.ID, string(cl.Properties.Username), topic, write)
+		return false
+	}
 	return true
 }
 func (h *AuthHook) OnConnectAuthenticate(cl *mqtts.Client, pk packets.Packet) bool {
 	// mqtt_log_Printf("OnConnectAuthenticate: %v connect params: %+v", cl.ID, pk.Connect)
 	mqtt_log_Printf("OnConnectAuthenticate: %v, username: %v, password: %+v", cl.ID, string(pk.Connect.Username), string(pk.Connect.Password))
 
-	if Config.Mqtt_proxy_upstream == "" {
-		// proxying is disabled
+	if valid, ok := authenticateMqttUser(pk.Connect.Username, pk.Connect.Password); ok {
+		// integrations (e.g. Home Assistant) with an account are neither devices nor proxied
+		if !valid {
+			log.Printf("invalid password for %v", string(pk.Connect.Username))
+		}
+		return valid
+	}
+
+	if cl.Net.Listener == "tcp" && Config.Mqtt_clear_integrations {
+		// local integrations connect over the clear text listener, anonymously if there are no accounts
+		if len(Config.Mqtt_users) > 0 {
+			log.Printf("rejecting anonymous client %v on the clear text listener", cl.ID)
+			return false
+		}
 		return true
 	}
 
-	opts := mqttc.NewClientOptions()
-	opts.AddBroker(Config.Mqtt_proxy_upstream)
-	opts.SetKeepAlive(0xeb)
-	opts.SetBinaryWill(pk.Connect.WillTopic, []byte{}, pk.Connect.WillQos, pk.Connect.WillRetain)
-	opts.SetAutoReconnect(true)
-	opts.SetClientID(cl.ID)
-	opts.SetUsername(string(pk.Connect.Username))
-	opts.SetPassword(string(pk.Connect.Password))
-	opts.SetTLSConfig(&tls.Config{InsecureSkipVerify: true})
-	opts.SetDefaultPublishHandler(func(client mqttc.Client, msg mqttc.Message) {
-		mqtt_log_Printf("OnPublish from the upstream: %s, topic: %s payload: %s", cl.ID, msg.Topic(),
-			base64.StdEncoding.EncodeToString(msg.Payload()))
-		h.server.Publish(msg.Topic(), msg.Payload(), msg.Retained(), msg.Qos())
-	})
-	mqtt_log_Printf("connecting to the upstream mqtt broker: %v, %v", cl.ID, Config.Mqtt_proxy_upstream)
-	client := mqttc.NewClient(opts)
-	if token := client.Connect(); token.WaitTimeout(5*time.Second) && token.Error() != nil {
-		mqtt_log_Printf("Unable to connect to the upstream mqtt broker: %v", token.Error())
+	if !authenticateDevice(cl.ID, pk.Connect.Username, pk.Connect.Password) {
+		log.Printf("invalid credentials for the device %v", cl.ID)
 		return false
 	}
 
-	clientMap[cl.ID] = mqttClient{
-		client: client,
+	var link *upstreamLink
+	if proxyMode(cl.ID) != PROXY_OFFLINE {
+		// the upstream connection is set up in the background, so the device is accepted even if the cloud is down
+		tlsConfig, err := upstreamTLSConfig()
+		if err != nil {
+			// the device is not relayed rather than sending its credentials without verification
+			log.Printf("not relaying %v: %v", cl.ID, err)
+		} else {
+			link = newUpstreamLink(h.server, cl, pk, tlsConfig)
+		}
 	}
+	if previous := registry.Connect(cl.ID, link); previous != nil {
+		previous.Close()
+	}
+	polls.Start(cl.ID)
+	discovery.Start(cl.ID)
+	events.Publish(cl.ID, EVENT_CONNECT, nil)
 
 	return true
 }
 func (h *AuthHook) OnDisconnect(cl *mqtts.Client, err error, expire bool) {
 	mqtt_log_Printf("OnDisconnect on the local broker: %v: %v", cl.ID, err)
+	if errors.Is(cl.StopCause(), packets.ErrSessionTakenOver) {
+		// the device reconnected, the new session is already registered
+		return
+	}
 	h.server.Clients.Delete(cl.ID)
-	c := clientMap[cl.ID]
-	if c.client != nil {
-		c.client.Disconnect(0)
+	polls.Stop(cl.ID)
+	if link, ok := registry.Disconnect(cl.ID); ok {
+		if link != nil {
+			link.Close()
+		}
+		publishDeviceOffline(cl.ID)
+		events.Publish(cl.ID, EVENT_DISCONNECT, nil)
 	}
-	delete(clientMap, cl.ID)
 }
 func (h *AuthHook) Provides(b byte) bool {
 	return bytes.Contains([]byte{mqtts.OnConnectAuthenticate, mqtts.OnACLCheck, mqtts.OnPacketRead, mqtts.OnDisconnect}, []byte{b})
@@ -114,66 +137,119 @@ type MsgHook struct {
 
 func (h *MsgHook) OnPublish(cl *mqtts.Client, pk packets.Packet) (packets.Packet, error) {
 	mqtt_log_Printf("OnPublish on the local broker by %v: %v, %v", cl.ID, pk.TopicName, base64.StdEncoding.EncodeToString(pk.Payload))
-	if cl.ID != "inline" && !strings.Contains(pk.TopicName, "/inline/") {
-		c := clientMap[cl.ID]
-		if c.client != nil && c.client.IsConnected() {
-			mqtt_log_Printf("relaying to the upstream")
-			c.client.Publish(pk.TopicName, pk.FixedHeader.Qos, pk.FixedHeader.Retain, pk.Payload)
+	metricPublishes.WithLabelValues(topicSuffix(pk.TopicName)).Inc()
+	capture.Record(cl.ID, CAPTURE_IN, pk)
+	if cl.ID != "inline" && !strings.Contains(pk.TopicName, "/inline/") && proxyMode(cl.ID) != PROXY_OFFLINE {
+		link := registry.Upstream(cl.ID)
+		if link != nil {
+			if payload, ok := applyRelayRules(RELAY_UP, cl.ID, pk.TopicName, pk.Payload); ok {
+				mqtt_log_Printf("relaying to the upstream")
+				link.Publish(pk.TopicName, pk.FixedHeader.Qos, pk.FixedHeader.Retain, payload)
+			}
 		}
 	}
 	if strings.HasSuffix(pk.TopicName, "/BIRTH") {
 		b, err := parseRawMessage(pk.Payload)
 		if err == nil {
-			c := clientMap[cl.ID]
-			c.birth = parseBirthMessage(b)
-			clientMap[cl.ID] = c
+			store.Save(cl.ID, STORE_BIRTH, pk.Payload)
+			birth := parseBirthMessage(b)
+			registry.SetBirth(cl.ID, birth)
+			events.Publish(cl.ID, EVENT_BIRTH, birth)
+			for _, r := range pollRequests {
+				polls.Trigger(cl.ID, r.name, 0)
+			}
 		} else {
 			mqtt_log_Printf("Error while decoding the birth payload: %v", err)
 		}
 	} else if strings.HasSuffix(pk.TopicName, "/REPLY/params") {
 		b, err := parseRawMessage(pk.Payload)
 		if err == nil {
-			c := clientMap[cl.ID]
-			c.params, c.paramsLimits = parseParams(b)
-			clientMap[cl.ID] = c
+			pollReplied(cl.ID, "params")
+			polls.Replied(cl.ID, "params")
+			store.Save(cl.ID, STORE_PARAMS, pk.Payload)
+			params, limits := parseParams(b)
+			old := registry.Params(cl.ID)
+			registry.SetParams(cl.ID, params, limits)
+			events.ParamsChanged(cl.ID, old, params)
+			writes.OnParams(cl.ID, params)
+			recordHistory(cl.ID, params)
+			publishDeviceState(cl.ID)
 		} else {
 			mqtt_log_Printf("Error while decoding the params payload: %v", err)
 		}
+	} else if strings.HasSuffix(pk.TopicName, "/REPLY/verify") {
+		b, err := parseRawMessage(pk.Payload)
+		if err == nil {
+			params, _ := parseParams(b)
+			events.ParamsChanged(cl.ID, registry.Params(cl.ID), params)
+			for key, value := range params {
+				registry.SetParam(cl.ID, key, value)
+			}
+			writes.OnVerify(cl.ID, params)
+		} else {
+			mqtt_log_Printf("Error while decoding the verify payload: %v", err)
+		}
+	} else if strings.Contains(pk.TopicName, "/REPLY/"+READ_REQUEST_PREFIX) {
+		b, err := parseRawMessage(pk.Payload)
+		if err == nil {
+			reads.OnReply(cl.ID, pk.TopicName, b)
+		} else {
+			mqtt_log_Printf("Error while decoding the read payload: %v", err)
+		}
+	} else if strings.HasSuffix(pk.TopicName, "/REPLY/result") {
+		b, err := parseRawMessage(pk.Payload)
+		if err == nil {
+			writes.OnResult(cl.ID, pk.TopicName, b)
+		} else {
+			mqtt_log_Printf("Error while decoding the result payload: %v", err)
+		}
 	} else if strings.HasSuffix(pk.TopicName, "/REPLY/consumptions") {
 		b, err := parseConsumptionMessage(pk.Payload)
 		if err == nil {
-			c := clientMap[cl.ID]
-			c.cWh = b
-			clientMap[cl.ID] = c
+			pollReplied(cl.ID, "consumptions")
+			polls.Replied(cl.ID, "consumptions")
+			store.Save(cl.ID, STORE_CONSUMPTIONS, pk.Payload)
+			events.ConsumptionChanged(cl.ID, registry.Consumption(cl.ID), b)
+			registry.SetConsumption(cl.ID, b)
 		} else {
 			mqtt_log_Printf("Error while decoding the params payload: %v", err)
 		}
-	} else if strings.HasSuffix(pk.TopicName, "/ErrListRst") {
+	} else if strings.HasSuffix(pk.TopicName, "/ErrListRst") && cl.ID != mqtts.InlineClientId {
 		b, err := parseRawMessage(pk.Payload)
 		if err == nil {
-			c := clientMap[cl.ID]
-			c.errors = b
-			clientMap[cl.ID] = c
+			pollReplied(cl.ID, "errors")
+			polls.Replied(cl.ID, "errors")
+			store.Save(cl.ID, STORE_ERRORS, pk.Payload)
+			events.ErrorsChanged(cl.ID, registry.Errors(cl.ID), b)
+			registry.SetErrors(cl.ID, b)
+			faults.Record(cl.ID, parseErrorList(cl.ID, b))
 		} else {
 			mqtt_log_Printf("Error while decoding the params payload: %v", err)
 		}
-	} else {
+	} else if strings.HasPrefix(pk.TopicName, "$EDC/") || strings.HasPrefix(pk.TopicName, "ari/") {
 		parseRawMessage(pk.Payload)
 	}
 	return pk, nil
 }
 func (h *MsgHook) OnSubscribe(cl *mqtts.Client, pk packets.Packet) packets.Packet {
-	c := clientMap[cl.ID]
+	link := registry.Upstream(cl.ID)
 	for _, s := range pk.Filters {
 		mqtt_log_Printf("OnSubscribe: %v", s.Filter)
-		if c.client != nil && c.client.IsConnected() {
-			c.client.Subscribe(s.Filter, s.Qos, nil)
+		if !relayFromUpstream(cl.ID, s.Filter) {
+			// the writes of the cloud would be dropped anyway
+			continue
+		}
+		if link != nil {
+			link.Subscribe(s.Filter, s.Qos)
 		}
 	}
 	return pk
 }
+func (h *MsgHook) OnPacketSent(cl *mqtts.Client, pk packets.Packet, b []byte) {
+	capture.Record(cl.ID, CAPTURE_OUT, pk)
+}
 func (h *MsgHook) Provides(b byte) bool {
-	return bytes.Contains([]byte{mqtts.OnPublish, mqtts.OnSubscribe}, []byte{b})
+	return bytes.Contains([]byte{mqtts.OnPublish, mqtts.OnSubscribe, mqtts.OnPacketSent}, []byte{b})
 }
 
 func mqttLogic() {
@@ -182,7 +258,23 @@ func mqttLogic() {
 		InlineClient: true,
 	})
 
+	if Config.Mqtt_proxy_upstream != "" {
+		if _, err := upstreamTLSConfig(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if Config.Mqtt_capture_path != "" {
+		c, err := openCapture(Config.Mqtt_capture_path)
+		if err != nil {
+			log.Fatalf("unable to open the capture: %v", err)
+		}
+		capture = c
+		log.Printf("capturing the MQTT messages to %v", Config.Mqtt_capture_path)
+	}
+
 	// Authz logic
+	warnDeviceCredentials()
 	ah := &AuthHook{server: server}
 	if err := server.AddHook(ah, nil); err != nil {
 		log.Fatal(err)
@@ -201,12 +293,7 @@ func mqttLogic() {
 	}
 
 	if Config.Mqtt_broker_tls_listener != "" {
-		cer, err := tls.LoadX509KeyPair(Config.Mqtt_broker_certificate_path, Config.Mqtt_broker_private_key_path)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		tlsConfig := &tls.Config{Certificates: []tls.Certificate{cer}}
+		tlsConfig := &tls.Config{GetCertificate: getBrokerCerts().GetCertificate}
 		tlsListener := listeners.NewTCP(listeners.Config{ID: "t1s", Address: Config.Mqtt_broker_tls_listener, TLSConfig: tlsConfig})
 		if err := server.AddListener(tlsListener); err != nil {
 			log.Fatal(err)
@@ -221,118 +308,4 @@ func mqttLogic() {
 			mqtt_log_Printf("Starting MQTT listener at %v\n", Config.Mqtt_broker_tls_listener)
 		}
 	}()
-
-	// Parameter scan
-	go func() {
-		// Wait for the first client
-		for {
-			connected := false
-			for clientId := range clientMap {
-				if clientMap[clientId].client.IsConnected() {
-					connected = true
-					break
-				}
-			}
-			if connected {
-				time.Sleep(time.Duration(2) * time.Second)
-				break
-			}
-			time.Sleep(time.Duration(1) * time.Second)
-		}
-
-		for {
-			for clientId := range clientMap {
-				mqtt_log_Printf("requesting parameters: %v", clientId)
-				for _, device := range Config.Devices {
-					if device.GwID == clientId {
-						if device.Sys == 4 {
-							if device.WheType == 6 {
-								m, err := getParamMessageRaw([]string{"T_18.0.0", "T_18.0.1", "T_18.0.2", "T_18.0.3", "T_18.0.5", "T_18.1.0", "T_18.1.3",
-									"T_18.3.0", "T_18.3.1", "T_18.3.2", "T_18.3.3", "T_18.3.5", "T_18.3.6"})
-								if err == nil {
-
-									err := server.Publish("$EDC/ari/"+clientId+"/ar1/GET/Menu/Par", m, false, 0)
-									if err != nil {
-										mqtt_log_Printf("unable to publish message to read out parameters to %v: %v", clientId, err)
-									}
-								} else {
-									mqtt_log_Printf("unable to build params query: %v", err)
-								}
-							}
-							if device.WheType == 2 {
-								m, err := getParamMessageRaw([]string{"T_22.0.0", "T_22.0.1", "T_22.0.2", "T_22.0.3", "T_22.0.4", "T_22.0.5", "T_22.1.0",
-									"T_22.1.1", "T_22.1.2", "T_22.1.3", "T_22.1.4", "T_22.2.1", "T_22.2.2", "T_22.3.0", "T_22.3.1", "T_22.3.4", "T_22.3.5",
-									"T_22.3.6", "T_22.3.9"})
-								if err == nil {
-
-									err := server.Publish("$EDC/ari/"+clientId+"/ar1/GET/Menu/Par", m, false, 0)
-									if err != nil {
-										mqtt_log_Printf("unable to publish message to read out parameters to %v: %v", clientId, err)
-									}
-								} else {
-									mqtt_log_Printf("unable to build params query: %v", err)
-								}
-							}
-						}
-					}
-				}
-			}
-
-			time.Sleep(time.Duration(Config.Poll_frequency) * time.Second)
-		}
-	}()
-
-	// Consumption scan
-	go func() {
-		// Wait for the first client
-		for {
-			connected := false
-			for clientId := range clientMap {
-				if clientMap[clientId].client.IsConnected() {
-					connected = true
-					break
-				}
-			}
-			if connected {
-				time.Sleep(time.Duration(10) * time.Second)
-				break
-			}
-			time.Sleep(time.Duration(1) * time.Second)
-		}
-		for {
-			for clientId := range clientMap {
-				mqtt_log_Printf("requesting consumptions: %v", clientId)
-				for _, device := range Config.Devices {
-					if device.GwID == clientId {
-						m, err := getConsumptionParamMessageRaw(device.ConsumptionTyp)
-						if err == nil {
-							err = server.Publish("$EDC/ari/"+clientId+"/ar1/GET/Stat/cWh", m, false, 0)
-							if err != nil {
-								mqtt_log_Printf("unable to publish message to read out consumptions to %v: %v", clientId, err)
-							}
-						}
-					}
-				}
-			}
-
-			time.Sleep(time.Duration(Config.Consumption_poll_frequency) * time.Second)
-		}
-	}()
-
-	// TODO error scan
-	// Error scan
-	// go func() {
-	// 	for {
-	// 		for clientId := range clientMap {
-	// 			mqtt_log_Printf("requesting parameters: %v", clientId)
-
-	// 			err := server.Publish("ari/"+clientId+"/ar1/Err/ErrListRst", nil, false, 0)
-	// 			if err != nil {
-	// 				mqtt_log_Printf("unable to publish message to read out parameters to %v: %v", clientId, err)
-	// 			}
-	// 		}
-
-	// 		time.Sleep(time.Duration(viper.GetInt("poll-frequency")) * time.Second)
-	// 	}
-	// }()
 }
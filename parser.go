@@ -16,16 +16,24 @@ func parser_log_Printf(t string, params ...any) {
 	log.Printf(t, params...)
 }
 
+// paramLimit is the allowed range of a parameter as reported by the device.
+type paramLimit struct {
+	Min int32
+	Max int32
+}
 
-func parseParams(msg *arimsgs.ParametersMsg) (map[string]int32, map[string]arimsgs.ParameterLimit) {
+func parseParams(msg *arimsgs.ParametersMsg) (map[string]int32, map[string]paramLimit) {
 	var paramResult = map[string]int32{}
-	var limitResult = map[string]arimsgs.ParameterLimit{}
+	var limitResult = map[string]paramLimit{}
 
 	for _, b := range msg.Params {
+		if b.Key == "requester.client.id" || b.Key == "request.id" {
+			continue
+		}
 		paramResult[b.Key] = b.GetValueI()
 	}
-	for _, c := range msg.ParamLimitsMsg.ParamLimits {
-		var minMaxResult arimsgs.ParameterLimit
+	for _, c := range msg.GetParamLimitsMsg().GetParamLimits() {
+		var minMaxResult paramLimit
 		minMaxResult.Max = c.Max
 		minMaxResult.Min = c.Min
 		limitResult[c.Key] = minMaxResult
@@ -44,6 +52,7 @@ func parseBirthMessage(msg *arimsgs.ParametersMsg) map[string]string {
 func parseRawMessage(rawMsg []byte) (*arimsgs.ParametersMsg, error) {
 	pm := &arimsgs.ParametersMsg{}
 	if err := proto.Unmarshal(rawMsg, pm); err != nil {
+		metricParseFailures.WithLabelValues("parameters").Inc()
 		return nil, err
 	}
 	parser_log_Printf("%s", pm)
@@ -53,13 +62,14 @@ func parseRawMessage(rawMsg []byte) (*arimsgs.ParametersMsg, error) {
 func parseConsumptionMessage(rawMsg []byte) (*arimsgs.ConsumptionMsg, error) {
 	cm := &arimsgs.ConsumptionMsg{}
 	if err := proto.Unmarshal(rawMsg, cm); err != nil {
+		metricParseFailures.WithLabelValues("consumption").Inc()
 		return nil, err
 	}
 	parser_log_Printf("%s", cm)
 	return cm, nil
 }
 
-func getParamMessage(cats []string) *arimsgs.ParametersMsg {
+func getParamMessage(cats []string, requestID string) *arimsgs.ParametersMsg {
 	p := &arimsgs.ParametersMsg{}
 	p.Timestamp = time.Now().UnixNano()
 	for i, c := range cats {
@@ -79,7 +89,7 @@ func getParamMessage(cats []string) *arimsgs.ParametersMsg {
 	p.Params = append(p.Params, &arimsgs.Parameter{
 		Key:        "request.id",
 		Something1: 5,
-		Value:      &arimsgs.Parameter_ValueS{ValueS: "params"},
+		Value:      &arimsgs.Parameter_ValueS{ValueS: requestID},
 	})
 
 	return p
@@ -110,7 +120,14 @@ func getConsumptionParamMessage(typ string) *arimsgs.ParametersMsg {
 }
 
 func getParamMessageRaw(cats []string) ([]byte, error) {
-	p := getParamMessage(cats)
+	p := getParamMessage(cats, "params")
+	return proto.Marshal(p)
+}
+
+// getVerifyMessageRaw reads back parameters after a write; the reply goes to REPLY/verify, so it does
+// not replace the polled parameter set.
+func getVerifyMessageRaw(cats []string) ([]byte, error) {
+	p := getParamMessage(cats, "verify")
 	return proto.Marshal(p)
 }
 
@@ -0,0 +1,72 @@
+package main
+
+import (
+	URL "net/url"
+	"strings"
+)
+
+const (
+	PROXY_RELAY   = "relay"   // messages are relayed to the vendor and back
+	PROXY_MIRROR  = "mirror"  // the telemetry of the device is relayed to the vendor, the writes of the cloud are dropped
+	PROXY_OFFLINE = "offline" // the vendor is never contacted
+)
+
+// proxyMode returns how the device is proxied to the upstream broker: the ProxyMode of the device if set,
+// otherwise Mqtt_proxy_mode. Without an upstream broker every device is offline, and so are the fake devices
+// of broker-ari replay.
+func proxyMode(clID string) string {
+	if Config.Mqtt_proxy_upstream == "" || strings.HasPrefix(clID, REPLAY_CLIENT_PREFIX) {
+		return PROXY_OFFLINE
+	}
+	mode := Config.Mqtt_proxy_mode
+	if device, ok := findDevice(clID); ok && device.ProxyMode != "" {
+		mode = device.ProxyMode
+	}
+	switch mode {
+	case PROXY_MIRROR, PROXY_OFFLINE:
+		return mode
+	default:
+		return PROXY_RELAY
+	}
+}
+
+// isWriteTopic tells if the topic is a request changing the state of the device, e.g.
+// $EDC/ari/<gw>/ar1/PUT/Menu/Par. Filters with wildcards only match if the method is explicit.
+func isWriteTopic(topic string) bool {
+	method, _, _ := strings.Cut(topicSuffix(topic), "/")
+	switch method {
+	case "PUT", "POST", "EXEC", "DEL":
+		return true
+	}
+	return false
+}
+
+// relayFromUpstream tells if a message of the upstream broker may be delivered to the device.
+func relayFromUpstream(clID, topic string) bool {
+	switch proxyMode(clID) {
+	case PROXY_RELAY:
+		return true
+	case PROXY_MIRROR:
+		return !isWriteTopic(topic)
+	}
+	return false
+}
+
+// proxyStatus serves GET /proxy: the proxy mode of every device and the state of its upstream connection.
+func proxyStatus(path string, body any, params URL.Values, method string) any {
+	re := []any{}
+	for _, clID := range registry.IDs() {
+		c, _ := registry.Get(clID)
+		a := map[string]any{
+			"gw":        clID,
+			"mode":      proxyMode(clID),
+			"connected": c.connected,
+			"upstream":  nil,
+		}
+		if c.client != nil {
+			a["upstream"] = c.client.Status()
+		}
+		re = append(re, a)
+	}
+	return re
+}
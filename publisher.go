@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	mqttc "github.com/eclipse/paho.mqtt.golang"
+	mqtts "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// publisher is where the integrations (e.g. Home Assistant) publish their messages to and
+// receive their commands from: either the built-in broker (through its inline client) or an external one.
+type publisher interface {
+	Publish(topic string, payload []byte, retain bool) error
+	Subscribe(filter string, handler func(topic string, payload []byte)) error
+}
+
+type inlinePublisher struct {
+	server *mqtts.Server
+	nextID int
+}
+
+func (p *inlinePublisher) Publish(topic string, payload []byte, retain bool) error {
+	return p.server.Publish(topic, payload, retain, 0)
+}
+
+func (p *inlinePublisher) Subscribe(filter string, handler func(topic string, payload []byte)) error {
+	p.nextID++
+	return p.server.Subscribe(filter, p.nextID, func(cl *mqtts.Client, sub packets.Subscription, pk packets.Packet) {
+		handler(pk.TopicName, pk.Payload)
+	})
+}
+
+type externalPublisher struct {
+	client mqttc.Client
+
+	mu            sync.Mutex
+	subscriptions map[string]func(topic string, payload []byte)
+}
+
+// newExternalPublisher connects to the broker in the background; subscriptions are restored on every reconnect.
+func newExternalPublisher(broker, clientID, username, password string) *externalPublisher {
+	p := &externalPublisher{subscriptions: map[string]func(topic string, payload []byte){}}
+	opts := mqttc.NewClientOptions()
+	opts.AddBroker(broker)
+	opts.SetClientID(clientID)
+	opts.SetUsername(username)
+	opts.SetPassword(password)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetConnectRetryInterval(10 * time.Second)
+	opts.SetOnConnectHandler(func(client mqttc.Client) {
+		log.Printf("connected to the mqtt broker %v", broker)
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		for filter, handler := range p.subscriptions {
+			client.Subscribe(filter, 0, messageHandler(handler))
+		}
+	})
+	p.client = mqttc.NewClient(opts)
+	p.client.Connect()
+	return p
+}
+
+func messageHandler(handler func(topic string, payload []byte)) mqttc.MessageHandler {
+	return func(client mqttc.Client, msg mqttc.Message) {
+		handler(msg.Topic(), msg.Payload())
+	}
+}
+
+func (p *externalPublisher) Publish(topic string, payload []byte, retain bool) error {
+	if !p.client.IsConnected() {
+		return mqttc.ErrNotConnected
+	}
+	token := p.client.Publish(topic, 0, retain, payload)
+	token.WaitTimeout(5 * time.Second)
+	return token.Error()
+}
+
+func (p *externalPublisher) Subscribe(filter string, handler func(topic string, payload []byte)) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.subscriptions[filter] = handler
+	if !p.client.IsConnected() {
+		// will be subscribed once the connection is up
+		return nil
+	}
+	token := p.client.Subscribe(filter, 0, messageHandler(handler))
+	token.WaitTimeout(5 * time.Second)
+	return token.Error()
+}
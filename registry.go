@@ -0,0 +1,235 @@
+package main
+
+import (
+	"maps"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/irsl/broker-ari/arimsgs"
+)
+
+// deviceRegistry holds the state of every gateway known to the broker. It is shared by the
+// mochi hooks, the pollers and the API handlers, so every accessor takes the lock and hands
+// out copies. The decoded protobuf messages are never modified once stored, so those are
+// shared by pointer.
+type deviceRegistry struct {
+	mu      sync.RWMutex
+	devices map[string]*mqttClient
+}
+
+var registry = newDeviceRegistry()
+
+func newDeviceRegistry() *deviceRegistry {
+	return &deviceRegistry{devices: map[string]*mqttClient{}}
+}
+
+// entry returns the state of the device, creating it if needed. The caller must hold the write lock.
+func (r *deviceRegistry) entry(id string) *mqttClient {
+	c, ok := r.devices[id]
+	if !ok {
+		c = &mqttClient{}
+		r.devices[id] = c
+	}
+	return c
+}
+
+// Get returns a snapshot of the device state.
+func (r *deviceRegistry) Get(id string) (mqttClient, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	c, ok := r.devices[id]
+	if !ok {
+		return mqttClient{}, false
+	}
+	return c.clone(), true
+}
+
+// IDs returns the sorted list of the known gateway IDs.
+func (r *deviceRegistry) IDs() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ids := make([]string, 0, len(r.devices))
+	for id := range r.devices {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// ConnectedIDs returns the sorted list of gateways that currently have a session on the local broker.
+func (r *deviceRegistry) ConnectedIDs() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ids := []string{}
+	for id, c := range r.devices {
+		if c.connected {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Connect registers a new session of the device along with its upstream link (which may be nil). The link
+// of the previous session is returned, it is up to the caller to close it.
+func (r *deviceRegistry) Connect(id string, client *upstreamLink) *upstreamLink {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := r.entry(id)
+	previous := c.client
+	c.connected = true
+	c.client = client
+	return previous
+}
+
+// Disconnect marks the session of the device closed and returns its upstream link. The last known
+// state is kept, but it is stale until the device reports again.
+func (r *deviceRegistry) Disconnect(id string) (*upstreamLink, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.devices[id]
+	if !ok {
+		return nil, false
+	}
+	client := c.client
+	c.connected = false
+	c.client = nil
+	c.stale = true
+	return client, true
+}
+
+// MarkStale marks the state of the device as not coming from the device itself, e.g. loaded from disk.
+func (r *deviceRegistry) MarkStale(id string, updated time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := r.entry(id)
+	c.stale = true
+	c.updated = updated
+}
+
+// Upstream returns the link relaying the device to the upstream broker, or nil.
+func (r *deviceRegistry) Upstream(id string) *upstreamLink {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if c, ok := r.devices[id]; ok {
+		return c.client
+	}
+	return nil
+}
+
+func (r *deviceRegistry) Birth(id string) map[string]string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if c, ok := r.devices[id]; ok {
+		return maps.Clone(c.birth)
+	}
+	return nil
+}
+
+func (r *deviceRegistry) Params(id string) map[string]int32 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if c, ok := r.devices[id]; ok {
+		return maps.Clone(c.params)
+	}
+	return nil
+}
+
+func (r *deviceRegistry) Limits(id string) map[string]paramLimit {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if c, ok := r.devices[id]; ok {
+		return maps.Clone(c.paramsLimits)
+	}
+	return nil
+}
+
+func (r *deviceRegistry) Consumption(id string) *arimsgs.ConsumptionMsg {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if c, ok := r.devices[id]; ok {
+		return c.cWh
+	}
+	return nil
+}
+
+func (r *deviceRegistry) Errors(id string) *arimsgs.ParametersMsg {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if c, ok := r.devices[id]; ok {
+		return c.errors
+	}
+	return nil
+}
+
+func (r *deviceRegistry) SetBirth(id string, birth map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entry(id).birth = birth
+}
+
+// SetParams replaces the parameters and limits of the device with a freshly read set.
+func (r *deviceRegistry) SetParams(id string, params map[string]int32, limits map[string]paramLimit) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := r.entry(id)
+	c.params = params
+	c.paramsLimits = limits
+	c.stale = false
+	c.updated = time.Now()
+}
+
+// SetParam updates a single cached parameter. It is a no-op until the parameters were read at least once.
+func (r *deviceRegistry) SetParam(id, key string, value int32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.devices[id]
+	if !ok || c.params == nil {
+		return
+	}
+	c.params[key] = value
+}
+
+// RestoreParam rolls back a cached parameter to old, unless it was updated since it was set to value.
+func (r *deviceRegistry) RestoreParam(id, key string, value, old int32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.devices[id]
+	if !ok || c.params == nil || c.params[key] != value {
+		return
+	}
+	c.params[key] = old
+}
+
+// RemoveParam drops the value set by SetParam for a parameter that was not known before, unless the device
+// reported a value in the meantime.
+func (r *deviceRegistry) RemoveParam(id, key string, value int32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.devices[id]
+	if !ok || c.params == nil || c.params[key] != value {
+		return
+	}
+	delete(c.params, key)
+}
+
+func (r *deviceRegistry) SetConsumption(id string, cWh *arimsgs.ConsumptionMsg) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entry(id).cWh = cWh
+}
+
+func (r *deviceRegistry) SetErrors(id string, errors *arimsgs.ParametersMsg) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entry(id).errors = errors
+}
+
+func (c *mqttClient) clone() mqttClient {
+	re := *c
+	re.birth = maps.Clone(c.birth)
+	re.params = maps.Clone(c.params)
+	re.paramsLimits = maps.Clone(c.paramsLimits)
+	return re
+}
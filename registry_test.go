@@ -0,0 +1,137 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+// TestRegistryConcurrentAccess exercises the writers of the hooks against the readers of the API; run it with -race.
+func TestRegistryConcurrentAccess(t *testing.T) {
+	r := newDeviceRegistry()
+	ids := []string{"GW1", "GW2", "GW3"}
+
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		id := id
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				r.Connect(id, nil)
+				r.SetBirth(id, map[string]string{"serial_number": id})
+				r.SetParams(id, map[string]int32{"T_18.1.0": int32(i)}, map[string]paramLimit{"T_18.1.0": {Min: 400, Max: 750}})
+				r.SetParam(id, "T_18.1.0", int32(i+1))
+				r.RestoreParam(id, "T_18.1.0", int32(i+1), int32(i))
+				r.Disconnect(id)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				for _, known := range r.IDs() {
+					c, _ := r.Get(known)
+					_ = c.params["T_18.1.0"]
+					_ = c.birth["serial_number"]
+				}
+				r.ConnectedIDs()
+				r.Params(id)
+				r.Limits(id)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := r.IDs(); len(got) != len(ids) {
+		t.Fatalf("IDs() = %v, want %v", got, ids)
+	}
+	for _, id := range ids {
+		c, ok := r.Get(id)
+		if !ok || c.connected || !c.stale {
+			t.Errorf("%v: ok = %v, connected = %v, stale = %v after the last Disconnect", id, ok, c.connected, c.stale)
+		}
+	}
+}
+
+// TestRegistryCopiesAreIndependent checks that the snapshots handed out share no maps with the registry.
+func TestRegistryCopiesAreIndependent(t *testing.T) {
+	r := newDeviceRegistry()
+	r.SetBirth("GW1", map[string]string{"serial_number": "SN1"})
+	r.SetParams("GW1", map[string]int32{"T_18.1.0": 550}, map[string]paramLimit{"T_18.1.0": {Min: 400, Max: 750}})
+
+	c, _ := r.Get("GW1")
+	c.birth["serial_number"] = "changed"
+	c.params["T_18.1.0"] = 1
+	c.paramsLimits["T_18.1.0"] = paramLimit{}
+	r.Birth("GW1")["serial_number"] = "changed"
+	r.Params("GW1")["T_18.1.0"] = 2
+	r.Limits("GW1")["T_18.1.0"] = paramLimit{}
+
+	c, _ = r.Get("GW1")
+	if c.birth["serial_number"] != "SN1" {
+		t.Errorf("birth was modified through a copy: %v", c.birth)
+	}
+	if c.params["T_18.1.0"] != 550 {
+		t.Errorf("params were modified through a copy: %v", c.params)
+	}
+	if l := c.paramsLimits["T_18.1.0"]; l.Min != 400 || l.Max != 750 {
+		t.Errorf("limits were modified through a copy: %v", c.paramsLimits)
+	}
+}
+
+func TestRegistryRestoreParam(t *testing.T) {
+	r := newDeviceRegistry()
+	r.SetParam("GW1", "T_18.1.0", 600)
+	if _, ok := r.Get("GW1"); ok {
+		t.Fatal("SetParam created a device before its parameters were read")
+	}
+
+	r.SetParams("GW1", map[string]int32{"T_18.1.0": 550}, nil)
+	r.SetParam("GW1", "T_18.1.0", 600)
+	r.RestoreParam("GW1", "T_18.1.0", 600, 550)
+	if got := r.Params("GW1")["T_18.1.0"]; got != 550 {
+		t.Errorf("RestoreParam: got %v, want 550", got)
+	}
+
+	// a value reported by the device in the meantime is kept
+	r.SetParam("GW1", "T_18.1.0", 600)
+	r.SetParam("GW1", "T_18.1.0", 650)
+	r.RestoreParam("GW1", "T_18.1.0", 600, 550)
+	if got := r.Params("GW1")["T_18.1.0"]; got != 650 {
+		t.Errorf("RestoreParam overwrote a newer value: got %v, want 650", got)
+	}
+}
+
+func TestRegistryRemoveParam(t *testing.T) {
+	r := newDeviceRegistry()
+	r.SetParams("GW1", map[string]int32{"T_18.1.0": 550}, nil)
+	r.SetParam("GW1", "T_18.0.1", 2)
+	r.RemoveParam("GW1", "T_18.0.1", 2)
+	if _, ok := r.Params("GW1")["T_18.0.1"]; ok {
+		t.Errorf("RemoveParam kept the value: %v", r.Params("GW1"))
+	}
+
+	// a value reported by the device in the meantime is kept
+	r.SetParam("GW1", "T_18.0.1", 2)
+	r.SetParam("GW1", "T_18.0.1", 3)
+	r.RemoveParam("GW1", "T_18.0.1", 2)
+	if got := r.Params("GW1")["T_18.0.1"]; got != 3 {
+		t.Errorf("RemoveParam dropped a newer value: got %v, want 3", got)
+	}
+}
+
+func TestRegistryConnectReturnsPreviousLink(t *testing.T) {
+	r := newDeviceRegistry()
+	first, second := &upstreamLink{}, &upstreamLink{}
+	if previous := r.Connect("GW1", first); previous != nil {
+		t.Errorf("first Connect returned %v", previous)
+	}
+	if previous := r.Connect("GW1", second); previous != first {
+		t.Errorf("Connect returned %v, want the link of the previous session", previous)
+	}
+	if link, ok := r.Disconnect("GW1"); !ok || link != second {
+		t.Errorf("Disconnect returned %v, %v", link, ok)
+	}
+	if link, ok := r.Disconnect("unknown"); ok || link != nil {
+		t.Errorf("Disconnect of an unknown device returned %v, %v", link, ok)
+	}
+}
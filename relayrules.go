@@ -0,0 +1,144 @@
+package main
+
+import (
+	"log"
+	"math"
+	"regexp"
+	"strings"
+
+	"github.com/irsl/broker-ari/arimsgs"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	RELAY_UP   = "up"   // device to cloud
+	RELAY_DOWN = "down" // cloud to device
+
+	RELAY_ALLOW   = "allow"
+	RELAY_DENY    = "deny"
+	RELAY_LOG     = "log"
+	RELAY_REWRITE = "rewrite"
+)
+
+// RelayRule filters the messages relayed between the devices and the upstream broker. The rules are
+// evaluated in order and the first allow, deny or rewrite rule matching the message decides; log rules
+// only log the message. Messages matching no rule are relayed.
+type RelayRule struct {
+	Topic     string   // topic filter, e.g. $EDC/ari/+/ar1/PUT/Menu/Par; empty matches every topic
+	Direction string   // up (device to cloud), down (cloud to device) or empty for both
+	Keys      []string // parameter keys or friendly names; empty matches every message
+	Action    string   // allow, deny, log or rewrite
+	Value     float64  // the new value (scaled) of the matching keys for rewrite
+}
+
+var (
+	metricRelayDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "broker_ari_relay_decisions_total",
+		Help: "Messages matched by the relay rules, by direction and action.",
+	}, []string{"direction", "action"})
+
+	// the keys of read requests are the values of P1, P2, ...
+	requestKeyRe = regexp.MustCompile(`^P\d+$`)
+)
+
+// topicMatches tells if the topic matches the MQTT topic filter.
+func topicMatches(filter, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) || (level != "+" && level != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+// matchesKeys tells if the message has any of the keys, either as a value or as a key to be read.
+func (r *RelayRule) matchesKeys(clID string, msg *arimsgs.ParametersMsg) bool {
+	if len(r.Keys) == 0 {
+		return true
+	}
+	if msg == nil {
+		return false
+	}
+	for _, p := range msg.Params {
+		for _, k := range r.Keys {
+			key := lookupParam(clID, k).Key
+			if p.Key == key || (requestKeyRe.MatchString(p.Key) && p.GetValueS() == key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rewrite sets the matching keys of the message to the value of the rule.
+func (r *RelayRule) rewrite(clID string, msg *arimsgs.ParametersMsg) {
+	for _, k := range r.Keys {
+		param := lookupParam(clID, k)
+		for _, p := range msg.Params {
+			if p.Key == param.Key {
+				p.Value = &arimsgs.Parameter_ValueI{ValueI: int32(math.Round(r.Value * float64(param.Scale)))}
+			}
+		}
+	}
+}
+
+// applyRelayRules decides if the message may be relayed in the direction and returns the payload to be relayed.
+func applyRelayRules(direction, clID, topic string, payload []byte) ([]byte, bool) {
+	var msg *arimsgs.ParametersMsg
+	decoded := false
+	for i := range Config.Relay_rules {
+		r := &Config.Relay_rules[i]
+		if r.Direction != "" && r.Direction != direction {
+			continue
+		}
+		if r.Topic != "" && !topicMatches(r.Topic, topic) {
+			continue
+		}
+		if len(r.Keys) > 0 && !decoded {
+			// not every message is a parameter list, e.g. consumptions
+			decoded = true
+			m := &arimsgs.ParametersMsg{}
+			if proto.Unmarshal(payload, m) == nil {
+				msg = m
+			}
+		}
+		if !r.matchesKeys(clID, msg) {
+			continue
+		}
+
+		metricRelayDecisions.WithLabelValues(direction, r.Action).Inc()
+		switch r.Action {
+		case RELAY_LOG:
+			log.Printf("relay rule %d: %v %v of %v", i, direction, topic, clID)
+		case RELAY_ALLOW:
+			mqtt_log_Printf("relay rule %d: allowing %v %v of %v", i, direction, topic, clID)
+			return payload, true
+		case RELAY_DENY:
+			log.Printf("relay rule %d: denying %v %v of %v", i, direction, topic, clID)
+			return nil, false
+		case RELAY_REWRITE:
+			if msg == nil {
+				log.Printf("relay rule %d: unable to rewrite %v %v of %v, denying", i, direction, topic, clID)
+				return nil, false
+			}
+			r.rewrite(clID, msg)
+			b, err := proto.Marshal(msg)
+			if err != nil {
+				log.Printf("relay rule %d: unable to rewrite %v %v of %v, denying: %v", i, direction, topic, clID, err)
+				return nil, false
+			}
+			log.Printf("relay rule %d: rewriting %v %v of %v", i, direction, topic, clID)
+			return b, true
+		default:
+			log.Printf("relay rule %d: unknown action %q", i, r.Action)
+		}
+	}
+	return payload, true
+}
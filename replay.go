@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	mqttc "github.com/eclipse/paho.mqtt.golang"
+	"github.com/irsl/broker-ari/arimsgs"
+	"google.golang.org/protobuf/proto"
+)
+
+// the prefix of the default client ID of the fake devices; these are never relayed to the vendor, see proxyMode
+const REPLAY_CLIENT_PREFIX = "replay-"
+
+// replayDevice plays a capture back as a fake device: it publishes what the device sent on its own (e.g. the
+// BIRTH) with the original timing, and answers the requests of the broker the way the captured device did.
+// The parameters are kept as a state, so the writes are read back.
+type replayDevice struct {
+	gw          string // the gateway in the capture
+	id          string // the client ID of the fake device
+	unsolicited []captureRecord
+	replies     map[string]captureRecord // the last reply of the device by request kind
+
+	mu     sync.Mutex
+	params map[string]*arimsgs.Parameter
+	limits map[string]*arimsgs.ParameterLimit
+	sent   map[string]int // own publications, which are delivered back by the subscriptions
+	client mqttc.Client
+}
+
+// captureGateway returns the device of the capture: the client sending a BIRTH, or else the first client
+// publishing to its own tree.
+func captureGateway(records []captureRecord) string {
+	for _, r := range records {
+		if r.Direction == CAPTURE_IN && strings.HasSuffix(r.Topic, "/BIRTH") {
+			return r.Client
+		}
+	}
+	for _, r := range records {
+		if gw, ok := topicGateway(r.Topic); ok && r.Direction == CAPTURE_IN && gw == r.Client {
+			return r.Client
+		}
+	}
+	return ""
+}
+
+// requestKind identifies a request regardless of the gateway, e.g. $EDC/ari/+/ar1/GET/Menu/Par.
+func requestKind(topic, gw string) string {
+	return strings.Replace(topic, "/"+gw+"/", "/+/", 1)
+}
+
+// requestMeta returns the requester and the ID of a request.
+func requestMeta(payload []byte) (requester, requestID string) {
+	msg := &arimsgs.ParametersMsg{}
+	if proto.Unmarshal(payload, msg) != nil {
+		return "", ""
+	}
+	for _, p := range msg.Params {
+		switch p.Key {
+		case "requester.client.id":
+			requester = p.GetValueS()
+		case "request.id":
+			requestID = p.GetValueS()
+		}
+	}
+	return requester, requestID
+}
+
+func newReplayDevice(records []captureRecord, gw, id string) *replayDevice {
+	d := &replayDevice{
+		gw:      gw,
+		id:      id,
+		replies: map[string]captureRecord{},
+		params:  map[string]*arimsgs.Parameter{},
+		limits:  map[string]*arimsgs.ParameterLimit{},
+		sent:    map[string]int{},
+	}
+	// the requests delivered to the device so far, without the publications of the device sent back to it
+	requests := []captureRecord{}
+	published := map[string]bool{}
+	for _, r := range records {
+		if r.Direction == CAPTURE_OUT && r.Client == gw {
+			if !published[r.Topic+"\x00"+string(r.Payload)] {
+				requests = append(requests, r)
+			}
+			continue
+		}
+		if r.Direction != CAPTURE_IN || r.Client != gw {
+			continue
+		}
+		published[r.Topic+"\x00"+string(r.Payload)] = true
+		// a reply names the request in its topic, other answers (e.g. ErrListRst) share the last part of the topic
+		var request *captureRecord
+		last := r.Topic[strings.LastIndex(r.Topic, "/")+1:]
+		for i := len(requests) - 1; i >= 0; i-- {
+			_, requestID := requestMeta(requests[i].Payload)
+			if (isReplyTopic(r.Topic) && requestID == last) || (!isReplyTopic(r.Topic) && strings.HasSuffix(requests[i].Topic, "/"+last)) {
+				request = &requests[i]
+				break
+			}
+		}
+		if request == nil {
+			d.unsolicited = append(d.unsolicited, r)
+			continue
+		}
+		kind := requestKind(request.Topic, gw)
+		d.replies[kind] = r
+		if strings.HasSuffix(kind, "/GET/Menu/Par") {
+			d.learn(r.Payload)
+		}
+	}
+	return d
+}
+
+// learn keeps the parameters and limits of a reply to GET/Menu/Par.
+func (d *replayDevice) learn(payload []byte) {
+	msg := &arimsgs.ParametersMsg{}
+	if proto.Unmarshal(payload, msg) != nil {
+		return
+	}
+	for _, p := range msg.Params {
+		if p.Key != "requester.client.id" && p.Key != "request.id" {
+			d.params[p.Key] = p
+		}
+	}
+	for _, l := range msg.GetParamLimitsMsg().GetParamLimits() {
+		d.limits[l.Key] = l
+	}
+}
+
+// rename moves a topic of the captured gateway to the fake device.
+func (d *replayDevice) rename(topic string) string {
+	return strings.Replace(topic, "/"+d.gw+"/", "/"+d.id+"/", 1)
+}
+
+func (d *replayDevice) publish(topic string, qos byte, payload []byte) {
+	d.mu.Lock()
+	d.sent[topic+"\x00"+string(payload)]++
+	d.mu.Unlock()
+	t := d.client.Publish(topic, qos, false, payload)
+	t.Wait()
+	if t.Error() != nil {
+		log.Printf("unable to publish %v: %v", topic, t.Error())
+	}
+}
+
+// own tells if the message is a publication of the fake device itself.
+func (d *replayDevice) own(topic string, payload []byte) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	k := topic + "\x00" + string(payload)
+	if d.sent[k] == 0 {
+		return false
+	}
+	d.sent[k]--
+	return true
+}
+
+func (d *replayDevice) onRequest(topic string, payload []byte) {
+	if d.own(topic, payload) {
+		return
+	}
+	kind := requestKind(topic, d.id)
+	requester, requestID := requestMeta(payload)
+	replyTopic := "$EDC/ari/" + requester + "/ar1/REPLY/" + requestID
+	log.Printf("request %v from %v (%v)", topic, requester, requestID)
+
+	switch {
+	case strings.HasSuffix(kind, "/GET/Menu/Par"):
+		msg := &arimsgs.ParametersMsg{Timestamp: time.Now().UnixNano()}
+		request := &arimsgs.ParametersMsg{}
+		proto.Unmarshal(payload, request)
+		d.mu.Lock()
+		for _, p := range request.Params {
+			if !strings.HasPrefix(p.Key, "P") {
+				continue
+			}
+			if v, ok := d.params[p.GetValueS()]; ok {
+				msg.Params = append(msg.Params, v)
+			}
+			if l, ok := d.limits[p.GetValueS()]; ok {
+				if msg.ParamLimitsMsg == nil {
+					msg.ParamLimitsMsg = &arimsgs.ParameterLimitsMsg{}
+				}
+				msg.ParamLimitsMsg.ParamLimits = append(msg.ParamLimitsMsg.ParamLimits, l)
+			}
+		}
+		d.mu.Unlock()
+		b, _ := proto.Marshal(msg)
+		d.publish(replyTopic, 0, b)
+	case strings.HasSuffix(kind, "/PUT/Menu/Par"):
+		request := &arimsgs.ParametersMsg{}
+		proto.Unmarshal(payload, request)
+		d.mu.Lock()
+		for _, p := range request.Params {
+			if p.Key != "requester.client.id" && p.Key != "request.id" {
+				d.params[p.Key] = &arimsgs.Parameter{Key: p.Key, Value: &arimsgs.Parameter_ValueI{ValueI: p.GetValueI()}}
+			}
+		}
+		d.mu.Unlock()
+		b, _ := proto.Marshal(&arimsgs.ParametersMsg{
+			Timestamp: time.Now().UnixNano(),
+			Params:    []*arimsgs.Parameter{{Key: "response.code", Value: &arimsgs.Parameter_ValueI{ValueI: 200}}},
+		})
+		d.publish(replyTopic, 0, b)
+	default:
+		r, ok := d.replies[kind]
+		if !ok {
+			log.Printf("no reply to %v in the capture", kind)
+			return
+		}
+		if isReplyTopic(r.Topic) && requester != "" {
+			d.publish(replyTopic, r.Qos, r.Payload)
+		} else {
+			d.publish(d.rename(r.Topic), r.Qos, r.Payload)
+		}
+	}
+}
+
+// play publishes the unsolicited messages of the device, speed times faster than captured (0: all at once).
+func (d *replayDevice) play(speed float64) {
+	var start time.Time
+	began := time.Now()
+	for i, r := range d.unsolicited {
+		if i == 0 {
+			start = r.Time
+		}
+		if speed > 0 {
+			time.Sleep(time.Until(began.Add(time.Duration(float64(r.Time.Sub(start)) / speed))))
+		}
+		log.Printf("publishing %v", d.rename(r.Topic))
+		d.publish(d.rename(r.Topic), r.Qos, r.Payload)
+	}
+}
+
+// replayCommand implements: broker-ari replay [-broker ssl://localhost:8883] [-client <id>] [-speed 1] <capture>
+// The fake device connects as replay-<gw> by default, so it does not take over the session of the real device.
+func replayCommand(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	broker := flags.String("broker", "ssl://localhost:8883", "the TLS listener of broker-ari")
+	clientID := flags.String("client", "", "client ID of the fake device, "+REPLAY_CLIENT_PREFIX+"<gateway of the capture> by default")
+	speed := flags.Float64("speed", 1, "replay the messages of the device this many times faster, 0 sends them at once")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %v replay [options] <capture file>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	records, err := readCapture(flags.Arg(0))
+	if err != nil {
+		log.Fatalf("unable to read the capture: %v", err)
+	}
+	gw := captureGateway(records)
+	if gw == "" {
+		log.Fatal("no device found in the capture")
+	}
+	id := *clientID
+	if id == "" {
+		id = REPLAY_CLIENT_PREFIX + gw
+	}
+	if !strings.HasPrefix(id, REPLAY_CLIENT_PREFIX) {
+		log.Printf("%v is proxied like a real device, set its ProxyMode to offline in Devices", id)
+	}
+	d := newReplayDevice(records, gw, id)
+	log.Printf("replaying %v as %v: %d messages, %d kinds of requests, %d parameters", gw, id, len(d.unsolicited), len(d.replies), len(d.params))
+
+	opts := mqttc.NewClientOptions()
+	opts.AddBroker(*broker)
+	opts.SetClientID(id)
+	// the certificate of broker-ari is usually self-signed
+	opts.SetTLSConfig(&tls.Config{InsecureSkipVerify: true})
+	// the requests are answered in order (e.g. a write and its read-back), but not in the callback of paho,
+	// which can not publish
+	requests := make(chan mqttc.Message, 100)
+	go func() {
+		for msg := range requests {
+			d.onRequest(msg.Topic(), msg.Payload())
+		}
+	}()
+	opts.SetOnConnectHandler(func(client mqttc.Client) {
+		for _, filter := range []string{"$EDC/ari/" + id + "/#", "ari/" + id + "/#"} {
+			client.Subscribe(filter, 0, func(client mqttc.Client, msg mqttc.Message) {
+				requests <- msg
+			})
+		}
+	})
+	d.client = mqttc.NewClient(opts)
+	if t := d.client.Connect(); t.Wait() && t.Error() != nil {
+		log.Fatalf("unable to connect to %v: %v", *broker, t.Error())
+	}
+	go d.play(*speed)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	<-sigs
+	d.client.Disconnect(250)
+}
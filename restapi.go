@@ -0,0 +1,262 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/irsl/broker-ari/arimsgs"
+	"google.golang.org/protobuf/proto"
+)
+
+// The native API: /api/v1/devices/<gw>/params/<key>, independent of the emulation of the official API.
+// The values are scaled, the keys are the parameter keys or the friendly names of the catalog.
+
+//go:embed api/openapi.json
+var openAPISpec []byte
+
+// paramView is a parameter as returned by the native API.
+type paramView struct {
+	Key         string   `json:"key"`
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Value       any      `json:"value"`
+	Raw         int32    `json:"raw"`
+	Unit        string   `json:"unit,omitempty"`
+	Min         *float64 `json:"min,omitempty"`
+	Max         *float64 `json:"max,omitempty"`
+	Writable    bool     `json:"writable"`
+}
+
+func newParamView(clID, key string, value int32, limits map[string]paramLimit) paramView {
+	p := lookupParam(clID, key)
+	v := paramView{Key: p.Key, Name: p.Id, Description: p.Name, Value: scaleValue(value, p.Scale), Raw: value, Unit: p.Unit, Writable: p.Writable}
+	if l, ok := limits[p.Key]; ok && (l.Min != 0 || l.Max != 0) {
+		min, max := float64(l.Min)/float64(p.Scale), float64(l.Max)/float64(p.Scale)
+		v.Min, v.Max = &min, &max
+	} else {
+		v.Min, v.Max = p.Min, p.Max
+	}
+	return v
+}
+
+func paramViews(clID string, params map[string]int32, limits map[string]paramLimit) []paramView {
+	re := []paramView{}
+	for key, value := range params {
+		re = append(re, newParamView(clID, key, value, limits))
+	}
+	sort.Slice(re, func(i, j int) bool { return re[i].Key < re[j].Key })
+	return re
+}
+
+// paramReader matches the replies of on-demand reads; every read has its own request.id, so the reply
+// goes to $EDC/ari/inline/ar1/REPLY/read-<n>.
+type paramReader struct {
+	next    atomic.Int64
+	pending sync.Map // read-<n> -> *pendingRead
+}
+
+// pendingRead is a read waiting for the reply of the device it was sent to.
+type pendingRead struct {
+	clID string
+	ch   chan *arimsgs.ParametersMsg
+}
+
+var reads = &paramReader{}
+
+const READ_REQUEST_PREFIX = "read-"
+
+// Read requests the keys from the device and waits for the reply.
+func (r *paramReader) Read(clID string, keys []string) (*arimsgs.ParametersMsg, error) {
+	id := fmt.Sprintf("%v%d", READ_REQUEST_PREFIX, r.next.Add(1))
+	b, err := proto.Marshal(getParamMessage(keys, id))
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan *arimsgs.ParametersMsg, 1)
+	r.pending.Store(id, &pendingRead{clID: clID, ch: ch})
+	defer r.pending.Delete(id)
+
+	if err := server.Publish("$EDC/ari/"+clID+"/ar1/GET/Menu/Par", b, false, 0); err != nil {
+		return nil, err
+	}
+	select {
+	case msg := <-ch:
+		return msg, nil
+	case <-time.After(writeTimeout()):
+		return nil, fmt.Errorf("no reply from the device in %v", writeTimeout())
+	}
+}
+
+// OnReply delivers the reply to REPLY/read-<n>, if it comes from the device the read was sent to.
+func (r *paramReader) OnReply(clID, topic string, msg *arimsgs.ParametersMsg) {
+	id := topic[strings.LastIndex(topic, "/")+1:]
+	if p, ok := r.pending.Load(id); ok && p.(*pendingRead).clID == clID {
+		select {
+		case p.(*pendingRead).ch <- msg:
+		default:
+		}
+	}
+}
+
+// readParams reads the keys (or friendly names) from the device and updates the cache with the values.
+func readParams(clID string, names []string) ([]paramView, *apiError) {
+	keys := make([]string, len(names))
+	for i, name := range names {
+		keys[i] = lookupParam(clID, name).Key
+	}
+	msg, err := reads.Read(clID, keys)
+	if err != nil {
+		return nil, newAPIError(http.StatusGatewayTimeout, "unable to read %v: %v", strings.Join(keys, ","), err)
+	}
+	params, limits := parseParams(msg)
+	events.ParamsChanged(clID, registry.Params(clID), params)
+	known := registry.Limits(clID)
+	for key, value := range params {
+		registry.SetParam(clID, key, value)
+		if _, ok := limits[key]; !ok {
+			limits[key] = known[key]
+		}
+	}
+	return paramViews(clID, params, limits), nil
+}
+
+func deviceView(clID string) map[string]any {
+	c, _ := registry.Get(clID)
+	a := map[string]any{
+		"gw":        clID,
+		"connected": c.connected,
+		"stale":     c.stale,
+		"sn":        c.birth["serial_number"],
+		"fwVer":     c.birth["firmware_version"],
+		"proxyMode": proxyMode(clID),
+		"upstream":  nil,
+	}
+	if c.client != nil {
+		a["upstream"] = c.client.Status()
+	}
+	if !c.updated.IsZero() {
+		a["updated"] = c.updated.UTC().Format(time.RFC3339)
+	}
+	device, ok := findDevice(clID)
+	a["configured"] = ok
+	if ok {
+		a["name"] = device.Name
+		a["sys"] = device.Sys
+		a["wheType"] = device.WheType
+	}
+	if m := deviceModel(clID); m != nil {
+		a["model"] = m.Name
+	}
+	return a
+}
+
+// knownDevice tells if the device connected at least once or is in Config.Devices.
+func knownDevice(clID string) bool {
+	if _, ok := registry.Get(clID); ok {
+		return true
+	}
+	_, ok := findDevice(clID)
+	return ok
+}
+
+// devicesV1 serves GET /api/v1/devices: the devices that connected at least once, then the configured ones that
+// did not connect yet (the entries without a GwID are skipped).
+func devicesV1(req *http.Request, s apiSession, body any) any {
+	if req.Method != http.MethodGet {
+		return newAPIError(http.StatusMethodNotAllowed, "unsupported method %v", req.Method)
+	}
+	re := []any{}
+	ids := registry.IDs()
+	for _, clID := range ids {
+		re = append(re, deviceView(clID))
+	}
+	for _, device := range Config.Devices {
+		if device.GwID != "" && !slices.Contains(ids, device.GwID) {
+			re = append(re, deviceView(device.GwID))
+			ids = append(ids, device.GwID)
+		}
+	}
+	return re
+}
+
+// deviceV1 serves
+//
+//	GET /api/v1/devices/<gw>
+//	GET /api/v1/devices/<gw>/params[?keys=a,b] (with keys, they are read from the device)
+//	GET /api/v1/devices/<gw>/params/<key>[?fresh=true]
+//	PUT /api/v1/devices/<gw>/params/<key> {"value": 55}
+//	GET /api/v1/devices/<gw>/consumption
+func deviceV1(req *http.Request, s apiSession, body any) any {
+	v := strings.Split(strings.TrimPrefix(req.URL.Path, "/api/v1/devices/"), "/")
+	clID := v[0]
+	if !knownDevice(clID) {
+		return newAPIError(http.StatusNotFound, "unknown device %v", clID)
+	}
+	method := req.Method
+	switch {
+	case len(v) == 1 && method == http.MethodGet:
+		return deviceView(clID)
+	case len(v) == 2 && v[1] == "params" && method == http.MethodGet:
+		if keys := req.URL.Query().Get("keys"); keys != "" {
+			views, e := readParams(clID, strings.Split(keys, ","))
+			if e != nil {
+				return e
+			}
+			return views
+		}
+		return paramViews(clID, registry.Params(clID), registry.Limits(clID))
+	case len(v) == 3 && v[1] == "params" && method == http.MethodGet:
+		p := lookupParam(clID, v[2])
+		if req.URL.Query().Get("fresh") == "true" {
+			views, e := readParams(clID, []string{p.Key})
+			if e != nil {
+				return e
+			}
+			if len(views) == 0 {
+				return newAPIError(http.StatusNotFound, "the device did not return %v", p.Key)
+			}
+			return views[0]
+		}
+		value, ok := registry.Params(clID)[p.Key]
+		if !ok {
+			return newAPIError(http.StatusNotFound, "%v is not known yet, use ?fresh=true to read it", p.Key)
+		}
+		return newParamView(clID, p.Key, value, registry.Limits(clID))
+	case len(v) == 2 && v[1] == "consumption" && method == http.MethodGet:
+		return consumptionEntries(clID, registry.Consumption(clID))
+	case len(v) == 3 && v[1] == "params" && method == http.MethodPut:
+		p := lookupParam(clID, v[2])
+		bmap, _ := body.(map[string]any)
+		value, ok := bmap["value"].(float64)
+		if !ok {
+			return newAPIError(http.StatusBadRequest, "the body must be like {\"value\": 55}")
+		}
+		raw := int32(math.Round(value * float64(p.Scale)))
+		if e, failed := velisPlantDataSet(clID, p.Key, raw).(*apiError); failed {
+			return e
+		}
+		return newParamView(clID, p.Key, registry.Params(clID)[p.Key], registry.Limits(clID))
+	}
+	return newAPIError(http.StatusNotFound, "no route for %v %v", method, req.URL.Path)
+}
+
+// openAPI serves the description of the native API; it is public, like the spec of any API.
+func openAPI(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+func restApiLogic() {
+	http.HandleFunc("/api/v1/openapi.json", openAPI)
+	http.HandleFunc("/api/v1/devices", sessionHandler("", devicesV1))
+	http.HandleFunc("/api/v1/devices/", sessionHandler("", deviceV1))
+	http.HandleFunc("/api/v1/events", eventsV1)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_POLL_FREQUENCY             = 60
+	DEFAULT_CONSUMPTION_POLL_FREQUENCY = 600
+
+	POLL_CONNECT_DELAY = 5 * time.Second // the device has to subscribe first
+	POLL_WRITE_DELAY   = 2 * time.Second
+	POLL_MAX_BACKOFF   = 30 * time.Minute
+	POLL_MAX_MISSES    = 5
+)
+
+// pollRequest is a kind of request sent to the devices periodically.
+type pollRequest struct {
+	name     string
+	interval func(clID string) time.Duration // 0 turns the request off
+	send     func(clID string) (bool, error) // false if there is nothing to request from the device
+}
+
+var pollRequests = []pollRequest{
+	{name: "params", interval: paramsPollInterval, send: pollParams},
+	{name: "consumptions", interval: consumptionsPollInterval, send: pollConsumptions},
+	{name: "errors", interval: errorsPollInterval, send: pollErrors},
+}
+
+// pollState is the schedule of a request of a device.
+type pollState struct {
+	timer   *time.Timer
+	pending bool // sent, but not answered yet
+	misses  int  // requests in a row the device did not answer
+}
+
+// pollScheduler polls every device on its own schedule: right after it connects or sends its BIRTH, shortly
+// after a write and then periodically, with some jitter so the requests of the devices are spread out. When
+// a device stops answering, the interval is doubled for every missed reply.
+type pollScheduler struct {
+	mu      sync.Mutex
+	devices map[string]map[string]*pollState
+}
+
+var polls = &pollScheduler{devices: map[string]map[string]*pollState{}}
+
+// Start schedules the first requests of a newly connected device.
+func (s *pollScheduler) Start(clID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stop(clID)
+	states := map[string]*pollState{}
+	s.devices[clID] = states
+	for _, r := range pollRequests {
+		states[r.name] = &pollState{}
+		s.schedule(clID, r, POLL_CONNECT_DELAY+jitter(time.Second))
+	}
+}
+
+// Stop cancels the requests of a disconnected device.
+func (s *pollScheduler) Stop(clID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stop(clID)
+}
+
+func (s *pollScheduler) stop(clID string) {
+	for _, st := range s.devices[clID] {
+		if st.timer != nil {
+			st.timer.Stop()
+		}
+	}
+	delete(s.devices, clID)
+}
+
+// Trigger sends the request to the device after the delay, instead of waiting for the next period.
+func (s *pollScheduler) Trigger(clID, name string, delay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range pollRequests {
+		if r.name == name {
+			s.schedule(clID, r, delay+jitter(time.Second))
+		}
+	}
+}
+
+// Replied records that the device answered the request.
+func (s *pollScheduler) Replied(clID, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st, ok := s.devices[clID][name]; ok {
+		st.pending = false
+		st.misses = 0
+	}
+}
+
+// schedule (re)arms the timer of the request. The caller must hold the lock.
+func (s *pollScheduler) schedule(clID string, r pollRequest, delay time.Duration) {
+	st, ok := s.devices[clID][r.name]
+	if !ok || r.interval(clID) == 0 {
+		return
+	}
+	if st.timer != nil {
+		st.timer.Stop()
+	}
+	st.timer = time.AfterFunc(delay, func() { s.fire(clID, r) })
+}
+
+func (s *pollScheduler) fire(clID string, r pollRequest) {
+	s.mu.Lock()
+	st, ok := s.devices[clID][r.name]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	if st.pending && st.misses < POLL_MAX_MISSES {
+		st.misses++
+		mqtt_log_Printf("no reply from %v to the %v request, backing off", clID, r.name)
+	}
+	interval := r.interval(clID)
+	next := interval << st.misses
+	if next > POLL_MAX_BACKOFF && interval < POLL_MAX_BACKOFF {
+		next = POLL_MAX_BACKOFF
+	}
+	s.schedule(clID, r, next+jitter(interval/10))
+	st.pending = true
+	s.mu.Unlock()
+
+	mqtt_log_Printf("requesting %v: %v", r.name, clID)
+	sent, err := r.send(clID)
+	if err != nil {
+		mqtt_log_Printf("unable to request %v from %v: %v", r.name, clID, err)
+	}
+	if !sent {
+		s.mu.Lock()
+		st.pending = false
+		s.mu.Unlock()
+	}
+}
+
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+func paramsPollInterval(clID string) time.Duration {
+	if device, ok := findDevice(clID); ok && device.PollFrequency > 0 {
+		return time.Duration(device.PollFrequency) * time.Second
+	}
+	if Config.Poll_frequency > 0 {
+		return time.Duration(Config.Poll_frequency) * time.Second
+	}
+	return DEFAULT_POLL_FREQUENCY * time.Second
+}
+
+func consumptionsPollInterval(clID string) time.Duration {
+	if Config.Consumption_poll_frequency > 0 {
+		return time.Duration(Config.Consumption_poll_frequency) * time.Second
+	}
+	return DEFAULT_CONSUMPTION_POLL_FREQUENCY * time.Second
+}
+
+func errorsPollInterval(clID string) time.Duration {
+	return time.Duration(Config.Error_poll_frequency) * time.Second
+}
+
+func pollParams(clID string) (bool, error) {
+	model := deviceModel(clID)
+	if model == nil || len(model.Params) == 0 {
+		return false, nil
+	}
+	m, err := getParamMessageRaw(model.PollKeys())
+	if err != nil {
+		return false, err
+	}
+	pollSent(clID, "params")
+	return true, server.Publish("$EDC/ari/"+clID+"/ar1/GET/Menu/Par", m, false, 0)
+}
+
+func pollConsumptions(clID string) (bool, error) {
+	device, ok := findDevice(clID)
+	if !ok {
+		return false, nil
+	}
+	m, err := getConsumptionParamMessageRaw(device.ConsumptionTyp)
+	if err != nil {
+		return false, err
+	}
+	pollSent(clID, "consumptions")
+	return true, server.Publish("$EDC/ari/"+clID+"/ar1/GET/Stat/cWh", m, false, 0)
+}
+
+func pollErrors(clID string) (bool, error) {
+	pollSent(clID, "errors")
+	return true, server.Publish("ari/"+clID+"/ar1/Err/ErrListRst", nil, false, 0)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	STORE_BIRTH        = "birth"
+	STORE_PARAMS       = "params"
+	STORE_CONSUMPTIONS = "consumptions"
+	STORE_ERRORS       = "errors"
+	STORE_FAULTS       = "faults" // the fault history (JSON)
+
+	storeUpdatedSuffix = ".updated"
+)
+
+// stateStore keeps the last messages of every device on disk, so the API can serve the last known
+// values right after a restart. The raw payloads are stored, one bucket per gateway.
+type stateStore struct {
+	db *bolt.DB
+}
+
+// store is nil if persistence is disabled.
+var store *stateStore
+
+var devicesBucket = []byte("devices")
+
+func openStateStore(path string) (*stateStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(devicesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &stateStore{db: db}, nil
+}
+
+// Save stores the last message of the given kind of the device.
+func (s *stateStore) Save(clID, kind string, payload []byte) {
+	if s == nil {
+		return
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(devicesBucket).CreateBucketIfNotExists([]byte(clID))
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte(kind), payload); err != nil {
+			return err
+		}
+		ts := make([]byte, 8)
+		binary.BigEndian.PutUint64(ts, uint64(time.Now().Unix()))
+		return b.Put([]byte(kind+storeUpdatedSuffix), ts)
+	})
+	if err != nil {
+		log.Printf("unable to save the %v of %v: %v", kind, clID, err)
+	}
+}
+
+// Load feeds the stored messages into the registry; the devices are marked stale until they report again.
+func (s *stateStore) Load(r *deviceRegistry) {
+	if s == nil {
+		return
+	}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(devicesBucket).ForEachBucket(func(k []byte) error {
+			clID := string(k)
+			b := tx.Bucket(devicesBucket).Bucket(k)
+			if v := b.Get([]byte(STORE_BIRTH)); v != nil {
+				if m, err := parseRawMessage(v); err == nil {
+					r.SetBirth(clID, parseBirthMessage(m))
+				}
+			}
+			if v := b.Get([]byte(STORE_PARAMS)); v != nil {
+				if m, err := parseRawMessage(v); err == nil {
+					params, limits := parseParams(m)
+					r.SetParams(clID, params, limits)
+				}
+			}
+			if v := b.Get([]byte(STORE_CONSUMPTIONS)); v != nil {
+				if m, err := parseConsumptionMessage(v); err == nil {
+					r.SetConsumption(clID, m)
+				}
+			}
+			if v := b.Get([]byte(STORE_ERRORS)); v != nil {
+				if m, err := parseRawMessage(v); err == nil {
+					r.SetErrors(clID, m)
+				}
+			}
+			if v := b.Get([]byte(STORE_FAULTS)); v != nil {
+				faults.Load(clID, v)
+			}
+			var updated time.Time
+			if v := b.Get([]byte(STORE_PARAMS + storeUpdatedSuffix)); len(v) == 8 {
+				updated = time.Unix(int64(binary.BigEndian.Uint64(v)), 0)
+			}
+			r.MarkStale(clID, updated)
+			log.Printf("loaded the last known state of %v", clID)
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("unable to load the stored state: %v", err)
+	}
+}
+
+func storeLogic() {
+	if Config.State_db_path == "" {
+		return
+	}
+	s, err := openStateStore(Config.State_db_path)
+	if err != nil {
+		log.Fatalf("unable to open the state store: %v", err)
+	}
+	store = s
+	store.Load(registry)
+}
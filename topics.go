@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	STATE_TOPIC_PREFIX = "broker-ari"
+)
+
+var (
+	statePublishers   []publisher
+	localPublisher    *inlinePublisher
+	localPublisherMux sync.Mutex
+)
+
+func stateTopic(clID string, parts ...string) string {
+	return strings.Join(append([]string{STATE_TOPIC_PREFIX, clID}, parts...), "/")
+}
+
+func scaleValue(value, scale int32) any {
+	if scale <= 1 {
+		return value
+	}
+	return float64(value) / float64(scale)
+}
+
+// lookupParam finds the parameter by its friendly name or by its key. Parameters that are not in the
+// catalog model of the device are returned unscaled under their own key.
+func lookupParam(clID, name string) catalogParam {
+	if m := deviceModel(clID); m != nil {
+		if p, ok := m.Param(name); ok {
+			return p
+		}
+	}
+	return catalogParam{Key: name, Id: name, Scale: 1}
+}
+
+// deviceState returns the current parameters of the device, scaled and keyed by their friendly names.
+func deviceState(clID string) map[string]any {
+	params := registry.Params(clID)
+	if params == nil {
+		return nil
+	}
+	state := map[string]any{}
+	for key, value := range params {
+		p := lookupParam(clID, key)
+		state[p.Id] = scaleValue(value, p.Scale)
+	}
+	return state
+}
+
+// getLocalPublisher returns the publisher of the built-in broker, registering it on the first call.
+func getLocalPublisher() publisher {
+	localPublisherMux.Lock()
+	defer localPublisherMux.Unlock()
+	if localPublisher == nil {
+		localPublisher = &inlinePublisher{server: server}
+		addStatePublisher(localPublisher)
+	}
+	return localPublisher
+}
+
+// addStatePublisher makes the device states published to p and the commands accepted from p.
+func addStatePublisher(p publisher) {
+	statePublishers = append(statePublishers, p)
+	// the commands wait for the device to confirm the write, so they must not block the subscriber
+	err := p.Subscribe(stateTopic("+", "set", "+"), func(topic string, payload []byte) {
+		go stateCommand(topic, payload)
+	})
+	if err != nil {
+		log.Printf("unable to subscribe to the command topics: %v", err)
+	}
+}
+
+// publishDeviceState publishes the state of the device as a JSON message to broker-ari/<gw>/state
+// and each parameter as a scalar to broker-ari/<gw>/state/<name>.
+func publishDeviceState(clID string) {
+	state := deviceState(clID)
+	if state == nil {
+		return
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		mqtt_log_Printf("unable to marshal state of %v: %v", clID, err)
+		return
+	}
+	for _, p := range statePublishers {
+		if err := p.Publish(stateTopic(clID, "state"), b, true); err != nil {
+			mqtt_log_Printf("unable to publish state of %v: %v", clID, err)
+			continue
+		}
+		for name, value := range state {
+			p.Publish(stateTopic(clID, "state", name), []byte(fmt.Sprint(value)), true)
+		}
+		p.Publish(stateTopic(clID, "availability"), []byte("online"), true)
+	}
+	haAnnounceOnce(clID)
+}
+
+func publishDeviceOffline(clID string) {
+	for _, p := range statePublishers {
+		p.Publish(stateTopic(clID, "availability"), []byte("offline"), true)
+	}
+}
+
+// stateCommand handles the broker-ari/<gw>/set/<name> messages, the payload is the new value (scaled).
+func stateCommand(topic string, payload []byte) {
+	v := strings.Split(topic, "/")
+	if len(v) != 4 {
+		return
+	}
+	clID, name := v[1], v[3]
+	if _, ok := registry.Get(clID); !ok {
+		mqtt_log_Printf("command for unknown device %v", clID)
+		return
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(string(payload)), 64)
+	if err != nil {
+		mqtt_log_Printf("invalid value for %v of %v: %q", name, clID, payload)
+		return
+	}
+	p := lookupParam(clID, name)
+	mqtt_log_Printf("setting %v (%v) of %v to %v", name, p.Key, clID, value)
+	if _, failed := velisPlantDataSet(clID, p.Key, int32(math.Round(value*float64(p.Scale)))).(*apiError); failed {
+		mqtt_log_Printf("setting %v of %v failed", name, clID)
+	}
+	// the cache is rolled back if the write failed, so the state is republished in both cases
+	publishDeviceState(clID)
+}
+
+func stateLogic() {
+	if Config.Mqtt_state_topics {
+		getLocalPublisher()
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// The web UI is a static page using the native API, built into the binary.
+
+//go:embed ui
+var uiFiles embed.FS
+
+const (
+	DEFAULT_CONFIG_PATH = "/config/config.json"
+	MAX_CONFIG_SIZE     = 1 << 20
+	CONFIG_REDACTED     = "********" // sent in place of the secrets, and kept as is on save
+)
+
+var (
+	// the fields holding secrets, in any object of the config (the keys are case insensitive, like in viper)
+	configSecretKeys = []string{"api_password", "homeassistant_mqtt_password", "password", "password_hash"}
+	// the fields identifying the elements of the lists, e.g. Mqtt_users or Devices
+	configIdentityKeys = []string{"username", "gwid"}
+)
+
+func configPath() string {
+	if path := viper.ConfigFileUsed(); path != "" {
+		return path
+	}
+	return DEFAULT_CONFIG_PATH
+}
+
+func isConfigSecret(key string) bool {
+	return slices.Contains(configSecretKeys, strings.ToLower(key))
+}
+
+// configField looks up the field of a config object case insensitively.
+func configField(m map[string]any, key string) (any, bool) {
+	for k, v := range m {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// configElement returns the element of the current list matching the new one: the one with the same Username or
+// GwID, or else the one at the same position.
+func configElement(current []any, v any, i int) any {
+	if m, ok := v.(map[string]any); ok {
+		for _, key := range configIdentityKeys {
+			id, ok := configField(m, key)
+			if !ok || id == "" {
+				continue
+			}
+			for _, c := range current {
+				if cm, ok := c.(map[string]any); ok {
+					if cid, ok := configField(cm, key); ok && cid == id {
+						return c
+					}
+				}
+			}
+			return nil
+		}
+	}
+	if i < len(current) {
+		return current[i]
+	}
+	return nil
+}
+
+// redactConfig replaces the secrets of the config with CONFIG_REDACTED.
+func redactConfig(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			if s, ok := e.(string); ok && s != "" && isConfigSecret(k) {
+				v[k] = CONFIG_REDACTED
+			} else {
+				v[k] = redactConfig(e)
+			}
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = redactConfig(e)
+		}
+	}
+	return v
+}
+
+// unredactConfig puts the secrets of the current config back where the new one has CONFIG_REDACTED.
+func unredactConfig(v, current any) (any, error) {
+	switch v := v.(type) {
+	case map[string]any:
+		cm, _ := current.(map[string]any)
+		for k, e := range v {
+			c, _ := configField(cm, k)
+			if e == CONFIG_REDACTED && isConfigSecret(k) {
+				if _, ok := c.(string); !ok {
+					return nil, fmt.Errorf("the value of %v is redacted, but there is no such secret to keep", k)
+				}
+				v[k] = c
+				continue
+			}
+			var err error
+			if v[k], err = unredactConfig(e, c); err != nil {
+				return nil, err
+			}
+		}
+	case []any:
+		cl, _ := current.([]any)
+		for i, e := range v {
+			var err error
+			if v[i], err = unredactConfig(e, configElement(cl, e, i)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return v, nil
+}
+
+// encodeConfig formats the config like the sample config.json.
+func encodeConfig(v any) ([]byte, error) {
+	var b bytes.Buffer
+	e := json.NewEncoder(&b)
+	e.SetEscapeHTML(false)
+	e.SetIndent("", "    ")
+	if err := e.Encode(v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// readConfig reads config.json as generic JSON, so the keys unknown to this version are kept.
+func readConfig() (any, error) {
+	b, err := os.ReadFile(configPath())
+	if os.IsNotExist(err) {
+		return map[string]any{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// configV1 serves GET/PUT /api/v1/config for the admins: config.json with the secrets (passwords and password
+// hashes) redacted; the redacted values are kept on save. The editor is only enabled if an admin account is
+// configured, see hasAdminAccount. The file is watched, so most of the changes apply right away; the listeners
+// only change on restart.
+func configV1(w http.ResponseWriter, req *http.Request) {
+	if _, e := authorize(req, API_SCOPE_ADMIN); e != nil {
+		http.Error(w, e.Message, e.status)
+		return
+	}
+	if !hasAdminAccount() {
+		http.Error(w, "the config editor needs an admin account in Api_users or Api_username", http.StatusForbidden)
+		return
+	}
+	current, err := readConfig()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		b, err := encodeConfig(redactConfig(current))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	case http.MethodPut:
+		b, err := io.ReadAll(io.LimitReader(req.Body, MAX_CONFIG_SIZE))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var v any
+		if err := json.Unmarshal(b, &v); err != nil {
+			http.Error(w, "invalid config: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if v, err = unredactConfig(v, current); err != nil {
+			http.Error(w, "invalid config: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if b, err = encodeConfig(v); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// a config that would not be loaded on the next start is rejected
+		var c config
+		if err := json.Unmarshal(b, &c); err != nil {
+			http.Error(w, "invalid config: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := writeFileAtomic(configPath(), b, 0644); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("%v was updated through the API", configPath())
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"success": true}`))
+	default:
+		http.Error(w, "unsupported method "+req.Method, http.StatusMethodNotAllowed)
+	}
+}
+
+func uiLogic() {
+	files, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		log.Fatal(err)
+	}
+	http.Handle("/ui/", http.StripPrefix("/ui/", http.FileServer(http.FS(files))))
+	http.Handle("/ui", http.RedirectHandler("/ui/", http.StatusMovedPermanently))
+	http.HandleFunc("/api/v1/config", configV1)
+}
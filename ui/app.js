@@ -0,0 +1,320 @@
+// The UI only uses the native API (/api/v1), see /api/v1/openapi.json.
+"use strict";
+
+const $ = id => document.getElementById(id);
+
+let token = sessionStorage.getItem("token");
+let selected = null;
+let events = null;
+let consumption = [];
+
+function showMessage(text, ok) {
+    const m = $("message");
+    m.textContent = text;
+    m.className = ok ? "message ok" : "message";
+    m.hidden = !text;
+}
+
+async function api(method, path, body, raw) {
+    const options = {method: method, headers: {"Authorization": "Bearer " + token}};
+    if (body !== undefined) {
+        options.body = typeof body === "string" ? body : JSON.stringify(body);
+    }
+    const resp = await fetch(path, options);
+    const text = await resp.text();
+    if (resp.status === 400 && text.trim() === "Invalid token") {
+        logout();
+        throw new Error("please log in");
+    }
+    let data = text;
+    if (!raw || !resp.ok) {
+        try {
+            data = JSON.parse(text);
+        } catch (e) {
+        }
+    }
+    if (!resp.ok) {
+        throw new Error((data && data.Message) || text.trim() || resp.statusText);
+    }
+    return data;
+}
+
+function el(tag, text, className) {
+    const e = document.createElement(tag);
+    if (text !== undefined) {
+        e.textContent = text;
+    }
+    if (className) {
+        e.className = className;
+    }
+    return e;
+}
+
+// Login
+
+$("login").addEventListener("submit", async ev => {
+    ev.preventDefault();
+    const form = new FormData(ev.target);
+    const resp = await fetch("/accounts/login", {method: "POST", body: JSON.stringify({usr: form.get("usr"), pwd: form.get("pwd")})});
+    const data = await resp.json();
+    if (!data.token) {
+        showMessage(data.error || "unable to log in");
+        return;
+    }
+    token = data.token;
+    sessionStorage.setItem("token", token);
+    showMessage("");
+    route();
+});
+
+function logout() {
+    if (token) {
+        fetch("/accounts/logout", {method: "POST", headers: {"Authorization": "Bearer " + token}});
+    }
+    token = null;
+    sessionStorage.removeItem("token");
+    if (events) {
+        events.close();
+        events = null;
+    }
+    route();
+}
+
+$("logout").addEventListener("click", logout);
+
+// Devices
+
+async function loadDevices() {
+    const devices = await api("GET", "/api/v1/devices");
+    const list = $("device-list");
+    list.replaceChildren();
+    for (const d of devices) {
+        const tr = el("tr");
+        tr.append(el("td", d.gw), el("td", d.name || ""), el("td", d.model || "unknown"));
+        tr.append(el("td", d.connected ? "connected" : "disconnected", d.connected ? "on" : "off"));
+        const upstream = d.upstream ? d.upstream.state : d.proxyMode;
+        tr.append(el("td", upstream, d.upstream && d.upstream.state === "connected" ? "on" : ""));
+        tr.append(el("td", d.updated ? new Date(d.updated).toLocaleString() : ""));
+        if (d.gw === selected) {
+            tr.className = "selected";
+        }
+        tr.addEventListener("click", () => selectDevice(d));
+        list.append(tr);
+    }
+}
+
+async function selectDevice(d) {
+    selected = d.gw;
+    $("device").hidden = false;
+    $("device-title").textContent = d.name ? d.name + " (" + d.gw + ")" : d.gw;
+    for (const tr of $("device-list").children) {
+        tr.className = tr.firstChild.textContent === d.gw ? "selected" : "";
+    }
+    try {
+        renderParams(await api("GET", "/api/v1/devices/" + d.gw + "/params"));
+        consumption = await api("GET", "/api/v1/devices/" + d.gw + "/consumption");
+        renderConsumptionSeries();
+    } catch (e) {
+        showMessage(e.message);
+    }
+}
+
+function formatValue(p) {
+    return p.unit ? p.value + " " + p.unit : String(p.value);
+}
+
+function isSwitch(p) {
+    return p.min === 0 && p.max === 1;
+}
+
+function control(p) {
+    const td = el("td");
+    if (!p.writable) {
+        return td;
+    }
+    if (isSwitch(p)) {
+        const input = el("input");
+        input.type = "checkbox";
+        input.checked = p.value === 1;
+        input.addEventListener("change", () => setParam(p, input.checked ? 1 : 0, input));
+        td.append(input);
+        return td;
+    }
+    const input = el("input");
+    input.type = "number";
+    input.step = "any";
+    input.value = p.value;
+    if (p.min !== undefined) {
+        input.min = p.min;
+        input.max = p.max;
+    }
+    const button = el("button", "Set");
+    button.type = "button";
+    button.addEventListener("click", () => setParam(p, Number(input.value), button));
+    td.append(input, " ", button);
+    return td;
+}
+
+function renderParams(params) {
+    const body = $("params");
+    body.replaceChildren();
+    for (const p of params) {
+        const tr = el("tr");
+        tr.dataset.key = p.key;
+        tr.append(el("td", p.description || p.name), el("td", formatValue(p)), el("td", p.key), control(p));
+        body.append(tr);
+    }
+    if (params.length === 0) {
+        const tr = el("tr");
+        tr.append(el("td", "No parameters yet."));
+        body.append(tr);
+    }
+}
+
+// updateParams applies the changed parameters of an event.
+function updateParams(params) {
+    for (const p of params) {
+        const tr = $("params").querySelector("tr[data-key='" + CSS.escape(p.key) + "']");
+        if (!tr) {
+            continue;
+        }
+        tr.children[1].textContent = formatValue(p);
+        tr.children[3].replaceWith(control(p));
+    }
+}
+
+async function setParam(p, value, input) {
+    input.disabled = true;
+    try {
+        const updated = await api("PUT", "/api/v1/devices/" + selected + "/params/" + encodeURIComponent(p.key), {value: value});
+        updateParams([updated]);
+        showMessage(p.description + " was set to " + formatValue(updated), true);
+    } catch (e) {
+        showMessage(e.message);
+        selectDevice({gw: selected, name: ""});
+    } finally {
+        input.disabled = false;
+    }
+}
+
+// Consumption
+
+function renderConsumptionSeries() {
+    const select = $("consumption-series");
+    select.replaceChildren();
+    consumption.forEach((c, i) => {
+        const o = el("option", "type " + c.k + ", period " + c.p);
+        o.value = i;
+        select.append(o);
+    });
+    select.hidden = consumption.length === 0;
+    $("consumption-empty").hidden = consumption.length > 0;
+    renderConsumption();
+}
+
+$("consumption-series").addEventListener("change", renderConsumption);
+
+function renderConsumption() {
+    const svg = $("consumption-chart");
+    svg.replaceChildren();
+    const c = consumption[$("consumption-series").value];
+    svg.style.display = c ? "" : "none";
+    if (!c || c.v.length === 0) {
+        return;
+    }
+    const max = Math.max(...c.v, 0.001);
+    const width = 600 / c.v.length;
+    const ns = "http://www.w3.org/2000/svg";
+    c.v.forEach((kwh, i) => {
+        const h = kwh / max * 180;
+        const rect = document.createElementNS(ns, "rect");
+        rect.setAttribute("x", i * width + 1);
+        rect.setAttribute("y", 190 - h);
+        rect.setAttribute("width", Math.max(width - 2, 1));
+        rect.setAttribute("height", h);
+        const title = document.createElementNS(ns, "title");
+        title.textContent = kwh + " kWh";
+        rect.append(title);
+        svg.append(rect);
+    });
+    const label = document.createElementNS(ns, "text");
+    label.setAttribute("x", 2);
+    label.setAttribute("y", 10);
+    label.textContent = "max " + max + " kWh";
+    svg.append(label);
+}
+
+// Live updates
+
+function subscribe() {
+    if (events) {
+        return;
+    }
+    events = new EventSource("/api/v1/events?token=" + encodeURIComponent(token));
+    events.addEventListener("params", ev => {
+        const e = JSON.parse(ev.data);
+        if (e.gw === selected) {
+            updateParams(e.data);
+        }
+    });
+    events.addEventListener("consumption", ev => {
+        const e = JSON.parse(ev.data);
+        if (e.gw === selected) {
+            consumption = e.data;
+            renderConsumptionSeries();
+        }
+    });
+    for (const type of ["connect", "disconnect", "birth"]) {
+        events.addEventListener(type, () => loadDevices().catch(e => showMessage(e.message)));
+    }
+}
+
+// Config
+
+async function loadConfig() {
+    try {
+        $("config-text").value = await api("GET", "/api/v1/config", undefined, true);
+    } catch (e) {
+        showMessage(e.message);
+    }
+}
+
+$("config-reload").addEventListener("click", loadConfig);
+
+$("config-save").addEventListener("click", async () => {
+    const text = $("config-text").value;
+    try {
+        JSON.parse(text);
+    } catch (e) {
+        showMessage("invalid JSON: " + e.message);
+        return;
+    }
+    try {
+        await api("PUT", "/api/v1/config", text);
+        showMessage("config.json was saved", true);
+    } catch (e) {
+        showMessage(e.message);
+    }
+});
+
+// Navigation
+
+function route() {
+    const page = location.hash === "#config" ? "config" : "devices";
+    $("login").hidden = !!token;
+    $("nav").hidden = !token;
+    $("devices").hidden = !token || page !== "devices";
+    $("config").hidden = !token || page !== "config";
+    if (!token) {
+        return;
+    }
+    subscribe();
+    if (page === "config") {
+        loadConfig();
+    } else {
+        loadDevices().catch(e => showMessage(e.message));
+    }
+}
+
+window.addEventListener("hashchange", route);
+route();
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	mqttc "github.com/eclipse/paho.mqtt.golang"
+	mqtts "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+const (
+	DEFAULT_UPSTREAM_QUEUE_SIZE = 1000
+
+	UPSTREAM_MIN_BACKOFF = time.Second
+	UPSTREAM_MAX_BACKOFF = 5 * time.Minute
+
+	UPSTREAM_CONNECTING   = "connecting"
+	UPSTREAM_CONNECTED    = "connected"
+	UPSTREAM_RECONNECTING = "reconnecting"
+	UPSTREAM_CLOSED       = "closed"
+)
+
+type upstreamMessage struct {
+	topic   string
+	qos     byte
+	retain  bool
+	payload []byte
+}
+
+// upstreamLink relays a device to the upstream broker. The connection is set up in the background and
+// retried with backoff, so the device is accepted by the local broker even if the cloud is down. The
+// messages of the device are queued meanwhile (the oldest ones are dropped once the queue is full) and
+// the subscriptions of the device are restored on every connect.
+type upstreamLink struct {
+	clID   string
+	client mqttc.Client
+
+	mu            sync.Mutex
+	state         string
+	since         time.Time
+	lastError     string
+	queue         []upstreamMessage
+	flushing      bool // the queue is being relayed, new messages are queued behind it to keep the order
+	dropped       int
+	subscriptions map[string]byte
+	done          chan struct{}
+}
+
+// upstreamStatus is the state of the link served by the API.
+type upstreamStatus struct {
+	State     string    `json:"state"`
+	Since     time.Time `json:"since"`
+	LastError string    `json:"lastError,omitempty"`
+	Queued    int       `json:"queued"`
+	Dropped   int       `json:"dropped"`
+}
+
+func upstreamQueueSize() int {
+	if Config.Upstream_queue_size > 0 {
+		return Config.Upstream_queue_size
+	}
+	return DEFAULT_UPSTREAM_QUEUE_SIZE
+}
+
+// newUpstreamLink starts connecting the device to the upstream broker with the credentials of its local session.
+func newUpstreamLink(server *mqtts.Server, cl *mqtts.Client, pk packets.Packet, tlsConfig *tls.Config) *upstreamLink {
+	u := &upstreamLink{
+		clID:          cl.ID,
+		state:         UPSTREAM_CONNECTING,
+		since:         time.Now(),
+		subscriptions: map[string]byte{},
+		done:          make(chan struct{}),
+	}
+
+	opts := mqttc.NewClientOptions()
+	opts.AddBroker(Config.Mqtt_proxy_upstream)
+	opts.SetKeepAlive(0xeb)
+	opts.SetBinaryWill(pk.Connect.WillTopic, []byte{}, pk.Connect.WillQos, pk.Connect.WillRetain)
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(UPSTREAM_MAX_BACKOFF)
+	opts.SetClientID(cl.ID)
+	opts.SetUsername(string(pk.Connect.Username))
+	opts.SetPassword(string(pk.Connect.Password))
+	opts.SetTLSConfig(tlsConfig)
+	opts.SetDefaultPublishHandler(func(client mqttc.Client, msg mqttc.Message) {
+		mqtt_log_Printf("OnPublish from the upstream: %s, topic: %s payload: %s", cl.ID, msg.Topic(),
+			base64.StdEncoding.EncodeToString(msg.Payload()))
+		if !relayFromUpstream(cl.ID, msg.Topic()) {
+			log.Printf("dropping %v from the upstream for %v (proxy mode %v)", msg.Topic(), cl.ID, proxyMode(cl.ID))
+			return
+		}
+		if payload, ok := applyRelayRules(RELAY_DOWN, cl.ID, msg.Topic(), msg.Payload()); ok {
+			server.Publish(msg.Topic(), payload, msg.Retained(), msg.Qos())
+		}
+	})
+	opts.SetOnConnectHandler(func(client mqttc.Client) {
+		u.setState(UPSTREAM_CONNECTED, "")
+		go u.flush()
+	})
+	opts.SetConnectionLostHandler(func(client mqttc.Client, err error) {
+		mqtt_log_Printf("lost the upstream connection of %v: %v", cl.ID, err)
+		u.setState(UPSTREAM_RECONNECTING, err.Error())
+	})
+	u.client = mqttc.NewClient(opts)
+
+	go u.connect()
+	return u
+}
+
+// connect tries to connect until it succeeds or the link is closed; reconnects are handled by paho afterwards.
+func (u *upstreamLink) connect() {
+	backoff := UPSTREAM_MIN_BACKOFF
+	for {
+		mqtt_log_Printf("connecting to the upstream mqtt broker: %v, %v", u.clID, Config.Mqtt_proxy_upstream)
+		token := u.client.Connect()
+		select {
+		case <-token.Done():
+		case <-u.done:
+			// closed while connecting
+			go func() {
+				token.Wait()
+				u.client.Disconnect(0)
+			}()
+			return
+		}
+		if token.Error() == nil {
+			return
+		}
+		mqtt_log_Printf("Unable to connect to the upstream mqtt broker: %v", token.Error())
+		u.setState(UPSTREAM_CONNECTING, token.Error().Error())
+		select {
+		case <-time.After(backoff):
+		case <-u.done:
+			return
+		}
+		backoff *= 2
+		if backoff > UPSTREAM_MAX_BACKOFF {
+			backoff = UPSTREAM_MAX_BACKOFF
+		}
+	}
+}
+
+func (u *upstreamLink) setState(state, lastError string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.state == UPSTREAM_CLOSED {
+		return
+	}
+	if u.state != state {
+		u.state = state
+		u.since = time.Now()
+	}
+	if lastError != "" {
+		u.lastError = lastError
+	}
+}
+
+// flush restores the subscriptions and relays the queued messages after a connect. Publish keeps queuing
+// until the queue is drained, so the messages arriving meanwhile are relayed after the older ones; if a flush
+// is already running (e.g. after a quick reconnect), that one relays the queue.
+func (u *upstreamLink) flush() {
+	u.mu.Lock()
+	subscriptions := make(map[string]byte, len(u.subscriptions))
+	for filter, qos := range u.subscriptions {
+		subscriptions[filter] = qos
+	}
+	running := u.flushing
+	u.flushing = true
+	u.mu.Unlock()
+
+	if len(subscriptions) > 0 {
+		u.client.SubscribeMultiple(subscriptions, nil)
+	}
+	if running {
+		return
+	}
+	for {
+		u.mu.Lock()
+		queue := u.queue
+		u.queue = nil
+		if len(queue) == 0 || u.state != UPSTREAM_CONNECTED {
+			u.queue = queue
+			u.flushing = false
+			u.mu.Unlock()
+			return
+		}
+		u.mu.Unlock()
+
+		mqtt_log_Printf("relaying %d queued messages of %v to the upstream", len(queue), u.clID)
+		for _, m := range queue {
+			u.client.Publish(m.topic, m.qos, m.retain, m.payload)
+		}
+	}
+}
+
+// Publish relays the message, or queues it until the upstream connection is up.
+func (u *upstreamLink) Publish(topic string, qos byte, retain bool, payload []byte) {
+	u.mu.Lock()
+	if u.state == UPSTREAM_CLOSED {
+		u.mu.Unlock()
+		return
+	}
+	if u.state != UPSTREAM_CONNECTED || u.flushing || !u.client.IsConnectionOpen() {
+		if len(u.queue) >= upstreamQueueSize() {
+			u.queue = u.queue[1:]
+			u.dropped++
+		}
+		u.queue = append(u.queue, upstreamMessage{topic: topic, qos: qos, retain: retain, payload: payload})
+		u.mu.Unlock()
+		return
+	}
+	u.mu.Unlock()
+	u.client.Publish(topic, qos, retain, payload)
+}
+
+// Subscribe subscribes to the filter on the upstream broker now if connected, and on every reconnect.
+func (u *upstreamLink) Subscribe(filter string, qos byte) {
+	u.mu.Lock()
+	u.subscriptions[filter] = qos
+	u.mu.Unlock()
+	if u.client.IsConnectionOpen() {
+		u.client.Subscribe(filter, qos, nil)
+	}
+}
+
+func (u *upstreamLink) IsConnected() bool {
+	return u.client.IsConnectionOpen()
+}
+
+// Close disconnects from the upstream broker and drops the queued messages.
+func (u *upstreamLink) Close() {
+	u.mu.Lock()
+	if u.state == UPSTREAM_CLOSED {
+		u.mu.Unlock()
+		return
+	}
+	u.state = UPSTREAM_CLOSED
+	u.since = time.Now()
+	u.queue = nil
+	close(u.done)
+	u.mu.Unlock()
+	u.client.Disconnect(0)
+}
+
+func (u *upstreamLink) Status() upstreamStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return upstreamStatus{State: u.state, Since: u.since, LastError: u.lastError, Queued: len(u.queue), Dropped: u.dropped}
+}
+
+// upstreamTLSConfig builds the TLS settings of the upstream connections. The certificate of the broker is
+// verified against the system roots (or Upstream_tls_ca_path) unless Upstream_tls_insecure_skip_verify is
+// set, and it must match one of the Upstream_tls_fingerprints (SHA-256 of the certificate) if any is given.
+func upstreamTLSConfig() (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         Config.Upstream_tls_server_name,
+		InsecureSkipVerify: Config.Upstream_tls_insecure_skip_verify,
+	}
+	if Config.Upstream_tls_ca_path != "" {
+		pem, err := os.ReadFile(Config.Upstream_tls_ca_path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the upstream CA bundle: %v", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in the upstream CA bundle %v", Config.Upstream_tls_ca_path)
+		}
+	}
+	if Config.Upstream_tls_certificate_path != "" {
+		cert, err := tls.LoadX509KeyPair(Config.Upstream_tls_certificate_path, Config.Upstream_tls_private_key_path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load the upstream client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if len(Config.Upstream_tls_fingerprints) > 0 {
+		pins := map[string]bool{}
+		for _, f := range Config.Upstream_tls_fingerprints {
+			pin := strings.ToLower(strings.ReplaceAll(f, ":", ""))
+			if b, err := hex.DecodeString(pin); err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("invalid upstream certificate fingerprint %q", f)
+			}
+			pins[pin] = true
+		}
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("no upstream certificate")
+			}
+			sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+			if !pins[hex.EncodeToString(sum[:])] {
+				return fmt.Errorf("the upstream certificate %x is not pinned", sum)
+			}
+			return nil
+		}
+	}
+	if cfg.InsecureSkipVerify && cfg.VerifyConnection == nil {
+		log.Printf("WARNING: the certificate of the upstream broker is not verified")
+	}
+	return cfg, nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/irsl/broker-ari/arimsgs"
+	mqtts "github.com/mochi-mqtt/server/v2"
+)
+
+const (
+	DEFAULT_WRITE_TIMEOUT = 10
+	WRITE_VERIFY_INTERVAL = 1 * time.Second // the delay of reading the parameter again after a mismatch
+)
+
+// pendingWrite is a parameter write waiting for the device to confirm it.
+type pendingWrite struct {
+	key      string
+	value    int32
+	done     chan error
+	mismatch chan int32 // the values read back that differ from the written one
+}
+
+func (w *pendingWrite) finish(err error) {
+	select {
+	case w.done <- err:
+	default:
+	}
+}
+
+// wait waits for the device to confirm the write. A parameter read back with a different value is not final,
+// the device may not have processed the write yet: it is read again until the reply to the write arrives or
+// the timeout expires.
+func (w *pendingWrite) wait(clID string, get []byte) error {
+	var mismatch error
+	var retry <-chan time.Time
+	timeout := time.After(writeTimeout())
+	for {
+		select {
+		case err := <-w.done:
+			return err
+		case value := <-w.mismatch:
+			mismatch = fmt.Errorf("the device reports %v for %v instead of %v", value, w.key, w.value)
+			retry = time.After(WRITE_VERIFY_INTERVAL)
+		case <-retry:
+			retry = nil
+			if err := server.Publish("$EDC/ari/"+clID+"/ar1/GET/Menu/Par", get, false, 0); err != nil {
+				return err
+			}
+		case <-timeout:
+			if mismatch != nil {
+				return mismatch
+			}
+			return fmt.Errorf("no reply from the device in %v", writeTimeout())
+		}
+	}
+}
+
+// writeTracker matches the replies of the devices to the parameter writes. Writes are serialized per
+// device since the replies can not be told apart otherwise.
+type writeTracker struct {
+	mu      sync.Mutex
+	locks   map[string]*sync.Mutex
+	pending map[string]*pendingWrite
+}
+
+var writes = &writeTracker{locks: map[string]*sync.Mutex{}, pending: map[string]*pendingWrite{}}
+
+func (t *writeTracker) start(clID, key string, value int32) *pendingWrite {
+	t.mu.Lock()
+	l, ok := t.locks[clID]
+	if !ok {
+		l = &sync.Mutex{}
+		t.locks[clID] = l
+	}
+	t.mu.Unlock()
+
+	l.Lock()
+	w := &pendingWrite{key: key, value: value, done: make(chan error, 1), mismatch: make(chan int32, 1)}
+	t.mu.Lock()
+	t.pending[clID] = w
+	t.mu.Unlock()
+	return w
+}
+
+func (t *writeTracker) end(clID string) {
+	t.mu.Lock()
+	delete(t.pending, clID)
+	l := t.locks[clID]
+	t.mu.Unlock()
+	l.Unlock()
+}
+
+func (t *writeTracker) get(clID string) *pendingWrite {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.pending[clID]
+}
+
+// OnResult handles the /REPLY/result message of the device; only the replies to the writes of broker-ari
+// (requester inline) are taken, the vendor app may use the same request ID.
+func (t *writeTracker) OnResult(clID, topic string, msg *arimsgs.ParametersMsg) {
+	if requester, _ := topicGateway(topic); requester != mqtts.InlineClientId {
+		return
+	}
+	w := t.get(clID)
+	if w == nil {
+		return
+	}
+	w.finish(parseResponseCode(msg))
+}
+
+// OnParams confirms the pending write if the polled parameters contain the new value. A mismatch is not an
+// error here, since the poll may have been answered before the write was processed.
+func (t *writeTracker) OnParams(clID string, params map[string]int32) {
+	w := t.get(clID)
+	if w == nil {
+		return
+	}
+	if value, ok := params[w.key]; ok && value == w.value {
+		w.finish(nil)
+	}
+}
+
+// OnVerify checks the pending write against the parameters read back after it, see pendingWrite.wait.
+func (t *writeTracker) OnVerify(clID string, params map[string]int32) {
+	w := t.get(clID)
+	if w == nil {
+		return
+	}
+	value, ok := params[w.key]
+	if !ok {
+		return
+	}
+	if value != w.value {
+		select {
+		case w.mismatch <- value:
+		default:
+		}
+		return
+	}
+	w.finish(nil)
+}
+
+// parseResponseCode returns the error reported in a reply. The replies follow the Kura conventions:
+// response.code is 200 on success, anything else comes with response.exception.message.
+func parseResponseCode(msg *arimsgs.ParametersMsg) error {
+	code := int32(200)
+	message := ""
+	for _, p := range msg.GetParams() {
+		switch p.Key {
+		case "response.code":
+			if v, ok := p.Value.(*arimsgs.Parameter_ValueS); ok {
+				if n, err := strconv.Atoi(v.ValueS); err == nil {
+					code = int32(n)
+				}
+			} else {
+				code = p.GetValueI()
+			}
+		case "response.exception.message":
+			message = p.GetValueS()
+		}
+	}
+	if code == 200 || code == 0 {
+		return nil
+	}
+	return fmt.Errorf("the device rejected the request with code %d: %s", code, message)
+}
+
+// checkRange validates a write against the limits reported by the device, or the limits in the catalog
+// if the device does not report any for the parameter. Only the parameters marked Writable in the catalog
+// of the device can be written, the unknown keys and the parameters without any limits are rejected.
+func checkRange(clID, key string, value int32) error {
+	p := lookupParam(clID, key)
+	if !p.Writable {
+		return fmt.Errorf("%v is not writable", p.Id)
+	}
+	var min, max float64
+	if l, ok := registry.Limits(clID)[key]; ok && (l.Min != 0 || l.Max != 0) {
+		min, max = float64(l.Min), float64(l.Max)
+	} else if p.Min != nil && p.Max != nil {
+		min, max = *p.Min*float64(p.Scale), *p.Max*float64(p.Scale)
+	} else {
+		return fmt.Errorf("the limits of %v are unknown", p.Id)
+	}
+	if float64(value) < min || float64(value) > max {
+		return fmt.Errorf("%v must be between %v and %v", p.Id, scaleValue(int32(min), p.Scale), scaleValue(int32(max), p.Scale))
+	}
+	return nil
+}
+
+func writeTimeout() time.Duration {
+	if Config.Write_timeout <= 0 {
+		return DEFAULT_WRITE_TIMEOUT * time.Second
+	}
+	return time.Duration(Config.Write_timeout) * time.Second
+}
+
+// writeParam sets a parameter of the device and waits until the device confirms it, either by the reply
+// to the write or by reading the parameter back. The cache is updated right away, so the API returns the
+// new value even before the next poll, and rolled back if the write fails.
+func writeParam(clID, key string, value int32) error {
+	put, err := putParams(key, value)
+	if err != nil {
+		return err
+	}
+	get, err := getVerifyMessageRaw([]string{key})
+	if err != nil {
+		return err
+	}
+
+	w := writes.start(clID, key, value)
+	defer writes.end(clID)
+
+	old, hadOld := registry.Params(clID)[key]
+	registry.SetParam(clID, key, value)
+
+	err = server.Publish("$EDC/ari/"+clID+"/ar1/PUT/Menu/Par", put, false, 0)
+	if err == nil {
+		err = server.Publish("$EDC/ari/"+clID+"/ar1/GET/Menu/Par", get, false, 0)
+	}
+	if err == nil {
+		err = w.wait(clID, get)
+	}
+
+	if err != nil {
+		if hadOld {
+			registry.RestoreParam(clID, key, value, old)
+		} else {
+			registry.RemoveParam(clID, key, value)
+		}
+		return err
+	}
+	// a mismatching read-back may have replaced the new value in the meantime
+	registry.SetParam(clID, key, value)
+	// the cache was updated before the device confirmed the value, so the diff of the verify reply is empty
+	if !hadOld || old != value {
+		events.ParamsChanged(clID, nil, map[string]int32{key: value})
+	}
+	// a write may change other parameters too, e.g. the processed setpoint
+	polls.Trigger(clID, "params", POLL_WRITE_DELAY)
+	return nil
+}